@@ -10,7 +10,7 @@
 import { NextResponse, type NextRequest } from "next/server";
 import { prisma } from "@/lib/prisma";
 import { listArchiveDates, getArchiveUrl, isR2Configured } from "@/lib/r2";
-import { getR2Json } from "@/lib/r2-client";
+import { getR2Snapshots } from "@/lib/r2-client";
 
 function toCsv(rows: Record<string, unknown>[]): string {
   if (rows.length === 0) return "";
@@ -131,22 +131,22 @@ export async function GET(request: NextRequest) {
 
         const data: Record<string, unknown>[] = [];
         for (const key of keys) {
-          const snap = await getR2Json<SnapshotFile>(key);
-          if (!snap) continue;
-          for (const p of snap.positions) {
-            if (route && p.route !== route) continue;
-            data.push({
-              recorded_at: snap.recordedAt,
-              vehicle_id: p.vehicleId,
-              vehicle_num: p.vehicleNum ?? null,
-              route: p.route ?? null,
-              trip_id: p.tripId ?? null,
-              direction_id: p.directionId ?? null,
-              lat: p.lat,
-              lon: p.lon,
-              speed: p.speed ?? null,
-              heading: p.heading ?? null,
-            });
+          for (const snap of await getR2Snapshots<SnapshotFile>(key)) {
+            for (const p of snap.positions) {
+              if (route && p.route !== route) continue;
+              data.push({
+                recorded_at: snap.recordedAt,
+                vehicle_id: p.vehicleId,
+                vehicle_num: p.vehicleNum ?? null,
+                route: p.route ?? null,
+                trip_id: p.tripId ?? null,
+                direction_id: p.directionId ?? null,
+                lat: p.lat,
+                lon: p.lon,
+                speed: p.speed ?? null,
+                heading: p.heading ?? null,
+              });
+            }
           }
         }
 
@@ -5,7 +5,7 @@
 
 import { NextResponse, type NextRequest } from "next/server";
 import { prisma } from "@/lib/prisma";
-import { getR2Json } from "@/lib/r2-client";
+import { getR2Snapshots } from "@/lib/r2-client";
 import { computeGrade } from "@/lib/analytics/metrics";
 import { parseDateFilter } from "@/lib/analytics/date-filter";
 import { CACHE_1DAY, cacheFor } from "@/lib/analytics/cache";
@@ -214,19 +214,19 @@ export async function GET(request: NextRequest) {
       >();
 
       for (const key of keys) {
-        const snap = await getR2Json<SnapshotFile>(key);
-        if (!snap) continue;
-        for (const p of snap.positions) {
-          if (p.route !== route) continue;
-          if (!vehicleTrails.has(p.vehicleId)) {
-            vehicleTrails.set(p.vehicleId, []);
+        for (const snap of await getR2Snapshots<SnapshotFile>(key)) {
+          for (const p of snap.positions) {
+            if (p.route !== route) continue;
+            if (!vehicleTrails.has(p.vehicleId)) {
+              vehicleTrails.set(p.vehicleId, []);
+            }
+            vehicleTrails.get(p.vehicleId)!.push({
+              time: snap.recordedAt,
+              lat: p.lat,
+              lon: p.lon,
+              speed: p.speed ?? null,
+            });
           }
-          vehicleTrails.get(p.vehicleId)!.push({
-            time: snap.recordedAt,
-            lat: p.lat,
-            lon: p.lon,
-            speed: p.speed ?? null,
-          });
         }
       }
 
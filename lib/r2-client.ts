@@ -4,6 +4,7 @@
  * R2_SECRET_ACCESS_KEY, R2_BUCKET.
  */
 
+import { gunzipSync, zstdDecompressSync } from "node:zlib";
 import { S3Client, GetObjectCommand } from "@aws-sdk/client-s3";
 
 let _client: S3Client | null = null;
@@ -29,17 +30,64 @@ function getClient(): { client: S3Client; bucket: string } | null {
   return { client: _client, bucket: _bucket };
 }
 
-/** Fetch and parse a JSON object from R2. Returns null if R2 is not configured or key not found. */
-export async function getR2Json<T = unknown>(key: string): Promise<T | null> {
+/**
+ * Undo the worker's snapshot compression. Detected from the magic bytes rather
+ * than Content-Encoding, so plain, gzip and zstd objects all decode whether or
+ * not anything on the way already decompressed them.
+ */
+function decodeBody(bytes: Uint8Array): Buffer {
+  const buf = Buffer.from(bytes.buffer, bytes.byteOffset, bytes.byteLength);
+  if (buf[0] === 0x1f && buf[1] === 0x8b) return gunzipSync(buf);
+  if (buf.length >= 4 && buf.readUInt32LE(0) === 0xfd2fb528) return zstdDecompressSync(buf);
+  return buf;
+}
+
+/** Fetch an object from R2 as text. Returns null if R2 is not configured or key not found. */
+async function getR2Text(key: string): Promise<string | null> {
   const r2 = getClient();
   if (!r2) return null;
 
   try {
     const res = await r2.client.send(new GetObjectCommand({ Bucket: r2.bucket, Key: key }));
-    const body = await res.Body?.transformToString("utf-8");
-    if (!body) return null;
+    const bytes = await res.Body?.transformToByteArray();
+    if (!bytes || bytes.length === 0) return null;
+    return decodeBody(bytes).toString("utf-8");
+  } catch {
+    return null;
+  }
+}
+
+/** Fetch and parse a JSON object from R2. Returns null if R2 is not configured or key not found. */
+export async function getR2Json<T = unknown>(key: string): Promise<T | null> {
+  const body = await getR2Text(key);
+  if (!body) return null;
+  try {
     return JSON.parse(body) as T;
   } catch {
     return null;
   }
 }
+
+/**
+ * Fetch the snapshots in one object under snapshots/: a single cycle
+ * (HHMMSS.json) or a batch of cycles, one per line (HHMM.ndjson, written with
+ * SNAPSHOT_BATCH_MINUTES). Returns [] if R2 is not configured or key not found.
+ */
+export async function getR2Snapshots<T = unknown>(key: string): Promise<T[]> {
+  if (!key.endsWith(".ndjson")) {
+    const snap = await getR2Json<T>(key);
+    return snap ? [snap] : [];
+  }
+  const body = await getR2Text(key);
+  if (!body) return [];
+  const snaps: T[] = [];
+  for (const line of body.split("\n")) {
+    if (!line.trim()) continue;
+    try {
+      snaps.push(JSON.parse(line) as T);
+    } catch {
+      // A torn last line should not lose the rest of the batch
+    }
+  }
+  return snaps;
+}
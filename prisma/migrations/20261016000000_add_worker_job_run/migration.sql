@@ -0,0 +1,16 @@
+-- CreateTable
+CREATE TABLE "WorkerJobRun" (
+    "id" BIGSERIAL NOT NULL,
+    "job" TEXT NOT NULL,
+    "targetDate" DATE NOT NULL,
+    "targetHour" SMALLINT,
+    "status" TEXT NOT NULL,
+    "startedAt" TIMESTAMP(3) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    "finishedAt" TIMESTAMP(3),
+    "error" TEXT,
+
+    CONSTRAINT "WorkerJobRun_pkey" PRIMARY KEY ("id")
+);
+
+-- CreateIndex
+CREATE INDEX "WorkerJobRun_job_targetDate_idx" ON "WorkerJobRun"("job", "targetDate");
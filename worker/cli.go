@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const usageText = `Usage: worker [feed flags] <command> [flags]
+
+Commands:
+  collect                      collect positions and run scheduled jobs (default)
+  run <job> [date flags]       run one scheduled job now and exit
+  backfill [date flags]        rebuild daily aggregates from Parquet archives
+  list-jobs                    list scheduled jobs
+  archive [--rearchive] [date flags]
+                               write the daily Parquet archive (--rearchive replaces one)
+  cleanup [--dry-run] [date flags]
+                               delete snapshot files once their archive is verified
+  segments refresh             refresh route segments from OTP
+
+Date flags (for date-aware jobs; the default is the job's usual day):
+  --date YYYY-MM-DD            a single day
+  --from YYYY-MM-DD            first day of a range
+  --to YYYY-MM-DD              last day of a range (default --from)
+
+Run "worker <command> -h" for a command's flags.
+
+Feed flags:
+`
+
+func usage() {
+	fmt.Fprint(os.Stderr, usageText)
+	flag.PrintDefaults()
+}
+
+// newFlagSet returns a FlagSet for a command whose usage line is
+// "worker <synopsis>".
+func newFlagSet(name, synopsis string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: worker %s\n", synopsis)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// dateRange holds the --date / --from / --to flags shared by date-aware commands.
+type dateRange struct {
+	date, from, to string
+}
+
+func addDateFlags(fs *flag.FlagSet) *dateRange {
+	r := &dateRange{}
+	fs.StringVar(&r.date, "date", "", "run for a single day (YYYY-MM-DD)")
+	fs.StringVar(&r.from, "from", "", "first day of a range (YYYY-MM-DD)")
+	fs.StringVar(&r.to, "to", "", "last day of a range (YYYY-MM-DD, default --from)")
+	return r
+}
+
+func (r *dateRange) isSet() bool {
+	return r.date != "" || r.from != "" || r.to != ""
+}
+
+// days returns the UTC midnights the flags select, or a single zero date
+// (the job's default day) when none are set.
+func (r *dateRange) days() ([]time.Time, error) {
+	if !r.isSet() {
+		return []time.Time{{}}, nil
+	}
+	if r.date != "" {
+		if r.from != "" || r.to != "" {
+			return nil, fmt.Errorf("--date cannot be combined with --from/--to")
+		}
+		d, err := time.Parse("2006-01-02", r.date)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --date (use YYYY-MM-DD): %w", err)
+		}
+		return []time.Time{d}, nil
+	}
+	if r.from == "" {
+		return nil, fmt.Errorf("--to requires --from")
+	}
+	from, err := time.Parse("2006-01-02", r.from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --from (use YYYY-MM-DD): %w", err)
+	}
+	to := from
+	if r.to != "" {
+		if to, err = time.Parse("2006-01-02", r.to); err != nil {
+			return nil, fmt.Errorf("invalid --to (use YYYY-MM-DD): %w", err)
+		}
+	}
+	if to.Before(from) {
+		return nil, fmt.Errorf("--to %s is before --from %s", r.to, r.from)
+	}
+	var days []time.Time
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		days = append(days, d)
+	}
+	return days, nil
+}
+
+// workerEnv holds the connections shared by commands. store is nil without
+// R2 credentials (or STORAGE_BACKEND=local) and pool is nil without DATABASE_URL.
+type workerEnv struct {
+	store objectStore
+	pool  *pgxpool.Pool
+}
+
+// connect opens whichever of object storage and the database are configured.
+func connect(ctx context.Context) *workerEnv {
+	env := &workerEnv{}
+	env.connect(ctx)
+	return env
+}
+
+// connect fills in env's connections; jobs built from env use them from then on.
+func (env *workerEnv) connect(ctx context.Context) {
+	store, err := newObjectStore()
+	if err != nil {
+		fatal("invalid storage configuration", "error", err)
+	}
+	env.store = store
+
+	if dbURL := os.Getenv("DATABASE_URL"); dbURL != "" {
+		pool, err := newPool(ctx, dbURL)
+		if err != nil {
+			fatal("database connection failed", "error", err)
+		}
+		var ok int
+		if err := pool.QueryRow(ctx, "SELECT 1 as ok").Scan(&ok); err != nil {
+			fatal("database ping failed", "error", err)
+		}
+		slog.Info("database connection ok")
+		env.pool = pool
+	}
+}
+
+func (env *workerEnv) close() {
+	if env.pool != nil {
+		env.pool.Close()
+	}
+}
+
+// requireStore and requireDB log and return an error if the command needs a
+// connection that is not configured; the command returns it so its deferred
+// close still runs.
+func (env *workerEnv) requireStore(cmd string) error {
+	if env.store == nil {
+		slog.Error("storage not configured — set R2_ENDPOINT, R2_ACCESS_KEY_ID, R2_SECRET_ACCESS_KEY, or STORAGE_BACKEND=local", "command", cmd)
+		return errors.New("storage not configured")
+	}
+	return nil
+}
+
+func (env *workerEnv) requireDB(cmd string) error {
+	if env.pool == nil {
+		slog.Error("DATABASE_URL not configured — cannot run jobs that require database", "command", cmd)
+		return errors.New("database not configured")
+	}
+	return nil
+}
+
+// runForDays runs fn once per selected day, stopping at (and logging) the
+// first error, which it returns.
+func runForDays(ctx context.Context, tag string, days []time.Time, fn func(ctx context.Context, date time.Time) error) error {
+	for _, day := range days {
+		dayCtx := withLog(ctx, "job", tag)
+		if !day.IsZero() {
+			dayCtx = withLog(dayCtx, "target", day.Format("2006-01-02"))
+		}
+		start := time.Now()
+		logger(dayCtx).Info("job starting")
+		if err := fn(dayCtx, day); err != nil {
+			logger(dayCtx).Error("job failed", "duration", time.Since(start), "error", err)
+			return err
+		}
+		logger(dayCtx).Info("job succeeded", "duration", time.Since(start))
+	}
+	return nil
+}
+
+// cmdCollect runs the collector. Feed flags may be given before or after
+// the command name.
+func cmdCollect(ctx context.Context, args []string, sourceKind, feedURL, ngsiDialect string) {
+	fs := newFlagSet("collect", "collect [feed flags]")
+	fs.StringVar(&sourceKind, "source", sourceKind, "vehicle feed source: fiware, gtfs-rt, replay (env FEED_SOURCE)")
+	fs.StringVar(&feedURL, "feed-url", feedURL, "feed endpoint, or snapshot directory for replay (env FEED_URL)")
+	fs.StringVar(&ngsiDialect, "ngsi-dialect", ngsiDialect, "FIWARE broker dialect: v2, ld (env FIWARE_DIALECT)")
+	fs.Parse(args)
+
+	src, err := newFeedSource(sourceKind, feedURL, ngsiDialect)
+	if err != nil {
+		fatal("invalid feed source", "error", err)
+	}
+	runCollector(ctx, src)
+}
+
+// cmdRun runs one scheduled job and exits.
+func cmdRun(ctx context.Context, args []string) error {
+	fs := newFlagSet("run", "run <job> [--date D | --from D --to D] [--force]")
+	dates := addDateFlags(fs)
+	force := fs.Bool("force", false, "run even if a required upstream job has not succeeded for the date")
+
+	// Accept the job name before or after the flags.
+	var jobName string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		jobName, args = args[0], args[1:]
+	}
+	fs.Parse(args)
+	if jobName == "" && fs.NArg() > 0 {
+		jobName = fs.Arg(0)
+	}
+
+	// The jobs use env's connections once it is connected below.
+	env := &workerEnv{}
+	jobs := newJobs(env)
+	if err := validateJobGraph(jobs); err != nil {
+		fatal("invalid job configuration", "command", "run", "error", err)
+	}
+	// Schedules set the timezone of the default target date.
+	if err := configureSchedules(jobs); err != nil {
+		fatal("invalid job configuration", "command", "run", "error", err)
+	}
+	var job *scheduledJob
+	for i := range jobs {
+		if jobs[i].name == jobName {
+			job = &jobs[i]
+			break
+		}
+	}
+	if job == nil {
+		if jobName != "" {
+			fmt.Fprintf(os.Stderr, "Unknown job: %s\n", jobName)
+		}
+		fmt.Fprintln(os.Stderr, "Available jobs:")
+		for _, j := range jobs {
+			fmt.Fprintf(os.Stderr, "  - %s\n", j.name)
+		}
+		os.Exit(1)
+	}
+	if dates.isSet() && !job.dated {
+		fatal("job does not take a date", "job", job.name)
+	}
+	days, err := dates.days()
+	if err != nil {
+		fatal("invalid arguments", "command", "run", "error", err)
+	}
+
+	env.connect(ctx)
+	defer env.close()
+	if job.needsStore {
+		if err := env.requireStore("run"); err != nil {
+			return err
+		}
+	}
+	if job.needsDB {
+		if err := env.requireDB("run"); err != nil {
+			return err
+		}
+	}
+	// Manual runs are recorded like scheduled ones, so catch-up skips them.
+	store := newJobRunStore(env.pool)
+	for _, day := range days {
+		targets := []jobTarget{job.target(time.Now())}
+		if !day.IsZero() {
+			targets = job.targetsOn(day)
+		}
+		for _, t := range targets {
+			// runJob logs the failure.
+			if err := runJob(ctx, store, job, t, job.targetDate(t), !*force); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// cmdBackfill rebuilds aggregates for a date range from Parquet archives.
+func cmdBackfill(ctx context.Context, args []string) error {
+	fs := newFlagSet("backfill", "backfill --from D [--to D] [--force]")
+	dates := addDateFlags(fs)
+	force := fs.Bool("force", false, "rebuild dates already recorded as complete")
+	fs.Parse(args)
+
+	if !dates.isSet() {
+		fatal("--date or --from is required", "command", "backfill")
+	}
+	days, err := dates.days()
+	if err != nil {
+		fatal("invalid arguments", "command", "backfill", "error", err)
+	}
+
+	env := connect(ctx)
+	defer env.close()
+	if err := env.requireStore("backfill"); err != nil {
+		return err
+	}
+	if err := env.requireDB("backfill"); err != nil {
+		return err
+	}
+	ctx = withLog(ctx, "job", "backfill")
+	if err := runBackfill(ctx, env.pool, env.store, days[0], days[len(days)-1], *force); err != nil {
+		logger(ctx).Error("backfill failed", "error", err)
+		return err
+	}
+	return nil
+}
+
+// cmdListJobs prints the scheduled jobs with their effective schedules.
+func cmdListJobs(args []string) {
+	fs := newFlagSet("list-jobs", "list-jobs")
+	fs.Parse(args)
+
+	jobs := newJobs(&workerEnv{})
+	if err := validateJobGraph(jobs); err != nil {
+		fatal("invalid job configuration", "command", "list-jobs", "error", err)
+	}
+	if err := configureSchedules(jobs); err != nil {
+		fatal("invalid job configuration", "command", "list-jobs", "error", err)
+	}
+	fmt.Printf("Schedules in %s\n", scheduleLocation)
+	for _, j := range jobs {
+		next := "-"
+		if j.schedule != nil {
+			next = j.schedule.Next(time.Now()).In(scheduleLocation).Format("2006-01-02 15:04 MST")
+		}
+		var notes []string
+		if j.dated {
+			notes = append(notes, "date-aware")
+		}
+		if j.needsDB {
+			notes = append(notes, "needs database")
+		}
+		if j.needsStore {
+			notes = append(notes, "needs storage")
+		}
+		if len(j.after) > 0 {
+			notes = append(notes, "after "+strings.Join(j.after, ", "))
+		}
+		if len(j.requires) > 0 {
+			notes = append(notes, "requires "+strings.Join(j.requires, ", "))
+		}
+		fmt.Printf("%-20s %-14s next %-22s %s\n", j.name, j.spec, next, strings.Join(notes, ", "))
+	}
+}
+
+// cmdArchive writes the daily Parquet archive, or the hourly partitions with --hourly.
+func cmdArchive(ctx context.Context, args []string) error {
+	fs := newFlagSet("archive", "archive [--hourly | --rearchive] [--date D | --from D --to D]")
+	dates := addDateFlags(fs)
+	hourly := fs.Bool("hourly", false, "write hourly partitions instead of the daily archive")
+	rearchive := fs.Bool("rearchive", false, "rebuild and replace daily archives that already exist")
+	fs.Parse(args)
+
+	days, err := dates.days()
+	if err != nil {
+		fatal("invalid arguments", "command", "archive", "error", err)
+	}
+
+	env := connect(ctx)
+	defer env.close()
+	if err := env.requireStore("archive"); err != nil {
+		return err
+	}
+	return runForDays(ctx, "archive", days, func(ctx context.Context, date time.Time) error {
+		if *hourly {
+			return runArchiveHourly(ctx, env.store, date)
+		}
+		return runArchivePositions(ctx, env.store, date, *rearchive)
+	})
+}
+
+// cmdCleanup deletes snapshot files that are past the retention window.
+func cmdCleanup(ctx context.Context, args []string) error {
+	fs := newFlagSet("cleanup", "cleanup [--dry-run] [--date D | --from D --to D]")
+	dates := addDateFlags(fs)
+	dryRun := fs.Bool("dry-run", false, "report what would be deleted without deleting")
+	fs.Parse(args)
+
+	days, err := dates.days()
+	if err != nil {
+		fatal("invalid arguments", "command", "cleanup", "error", err)
+	}
+
+	env := connect(ctx)
+	defer env.close()
+	if err := env.requireStore("cleanup"); err != nil {
+		return err
+	}
+	return runForDays(ctx, "cleanup", days, func(ctx context.Context, date time.Time) error {
+		return runCleanupPositions(ctx, env.store, date, false, *dryRun)
+	})
+}
+
+// cmdSegments runs route-segment maintenance; "refresh" is the only action.
+func cmdSegments(ctx context.Context, args []string) error {
+	fs := newFlagSet("segments", "segments refresh")
+	fs.Parse(args)
+	if fs.NArg() != 1 || fs.Arg(0) != "refresh" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	env := connect(ctx)
+	defer env.close()
+	if err := env.requireDB("segments"); err != nil {
+		return err
+	}
+	return runForDays(ctx, "segments refresh", []time.Time{{}}, func(ctx context.Context, _ time.Time) error {
+		return runRefreshSegments(ctx, env.pool)
+	})
+}
@@ -1,41 +1,13 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
-	"log"
-	"net/http"
-	"regexp"
-	"strings"
 	"sync"
 	"time"
-
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
-// FIWARE entity types
-
-type fiwareEntity struct {
-	ID                     string          `json:"id"`
-	Type                   string          `json:"type"`
-	Location               json.RawMessage `json:"location"`
-	RouteShortName         json.RawMessage `json:"routeShortName"`
-	Route                  json.RawMessage `json:"route"`
-	LineID                 json.RawMessage `json:"lineId"`
-	Line                   json.RawMessage `json:"line"`
-	VehiclePlateIdentifier json.RawMessage `json:"vehiclePlateIdentifier"`
-	VehicleNumber          json.RawMessage `json:"vehicleNumber"`
-	LicensePlate           json.RawMessage `json:"license_plate"`
-	Name                   json.RawMessage `json:"name"`
-	Heading                json.RawMessage `json:"heading"`
-	Bearing                json.RawMessage `json:"bearing"`
-	Speed                  json.RawMessage `json:"speed"`
-	Annotations            json.RawMessage `json:"annotations"`
-}
-
 type positionRow struct {
 	vehicleID   string
 	vehicleNum  *string
@@ -46,6 +18,9 @@ type positionRow struct {
 	lon         float64
 	speed       *float32
 	heading     *float32
+	observedAt  *time.Time // when the source observed this position; nil = cycle time
+	stale       bool       // observedAt is older than the stale policy allows
+	duplicate   bool       // unchanged since the vehicle's previous cycle
 }
 
 // SnapshotPosition is the JSON shape written to R2 per position.
@@ -59,6 +34,135 @@ type SnapshotPosition struct {
 	Lon         float64  `json:"lon"`
 	Speed       *float32 `json:"speed,omitempty"`
 	Heading     *float32 `json:"heading,omitempty"`
+	ObservedAt  string   `json:"observedAt,omitempty"`
+	Stale       bool     `json:"stale,omitempty"`
+	Duplicate   bool     `json:"duplicate,omitempty"`
+}
+
+// newSnapshotPosition maps a row to its snapshot form (the inverse of
+// snapshotPositionToRow). ObservedAt keeps sub-second precision so a restart
+// can seed the dedup cache with times that still compare equal.
+func newSnapshotPosition(r *positionRow) SnapshotPosition {
+	sp := SnapshotPosition{
+		VehicleID:   r.vehicleID,
+		DirectionID: r.directionID,
+		Lat:         r.lat,
+		Lon:         r.lon,
+		Speed:       r.speed,
+		Heading:     r.heading,
+		Stale:       r.stale,
+		Duplicate:   r.duplicate,
+	}
+	if r.vehicleNum != nil {
+		sp.VehicleNum = *r.vehicleNum
+	}
+	if r.route != nil {
+		sp.Route = *r.route
+	}
+	if r.tripID != nil {
+		sp.TripID = *r.tripID
+	}
+	if r.observedAt != nil {
+		sp.ObservedAt = r.observedAt.UTC().Format(time.RFC3339Nano)
+	}
+	return sp
+}
+
+// positionTime returns when the position was observed by its source, falling
+// back to the snapshot's recordedAt for sources without per-position times.
+func (p *SnapshotPosition) positionTime(recordedAt time.Time) time.Time {
+	if p.ObservedAt == "" {
+		return recordedAt
+	}
+	t, err := time.Parse(time.RFC3339, p.ObservedAt)
+	if err != nil {
+		return recordedAt
+	}
+	return t.UTC()
+}
+
+// stalePolicy decides what happens to positions whose source timestamp is
+// older than maxAge when collected, e.g. buses frozen on the broker.
+type stalePolicy struct {
+	maxAge time.Duration
+	mode   string // "drop" (default), "flag" or "keep"
+}
+
+var staleness = stalePolicy{maxAge: 5 * time.Minute, mode: "drop"}
+
+// apply drops or flags stale rows and returns the rows to keep plus how many
+// were stale. Rows without a source timestamp are never stale.
+func (p stalePolicy) apply(rows []*positionRow, now time.Time) ([]*positionRow, int) {
+	if p.mode == "keep" {
+		return rows, 0
+	}
+	kept := rows[:0]
+	stale := 0
+	for _, r := range rows {
+		if r.observedAt != nil && now.Sub(*r.observedAt) > p.maxAge {
+			stale++
+			if p.mode != "flag" {
+				continue
+			}
+			r.stale = true
+		}
+		kept = append(kept, r)
+	}
+	return kept, stale
+}
+
+// dedupCache remembers each vehicle's last collected position so positions the
+// broker has not refreshed since the previous cycle can be flagged or dropped.
+type dedupCache struct {
+	mu   sync.Mutex
+	mode string // "flag" (default), "drop" or "keep"
+	last map[string]lastPosition
+}
+
+type lastPosition struct {
+	lat, lon   float64
+	observedAt time.Time // zero if the source has no per-position time
+	seenAt     time.Time
+}
+
+var dedup = &dedupCache{mode: "flag", last: make(map[string]lastPosition)}
+
+// dedupEvictAfter bounds the cache to vehicles seen within the last hour.
+const dedupEvictAfter = time.Hour
+
+// apply compares rows with the cache, flags or drops duplicates, and returns
+// the rows to keep plus how many were duplicates. A position is a duplicate
+// when its coordinates and source timestamp both match the previous cycle.
+func (c *dedupCache) apply(rows []*positionRow, now time.Time) ([]*positionRow, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	kept := rows[:0]
+	duplicates := 0
+	for _, r := range rows {
+		var observedAt time.Time
+		if r.observedAt != nil {
+			observedAt = *r.observedAt
+		}
+		prev, seen := c.last[r.vehicleID]
+		c.last[r.vehicleID] = lastPosition{lat: r.lat, lon: r.lon, observedAt: observedAt, seenAt: now}
+
+		if c.mode != "keep" && seen && prev.lat == r.lat && prev.lon == r.lon && prev.observedAt.Equal(observedAt) {
+			duplicates++
+			if c.mode == "drop" {
+				continue
+			}
+			r.duplicate = true
+		}
+		kept = append(kept, r)
+	}
+
+	for id, p := range c.last {
+		if now.Sub(p.seenAt) > dedupEvictAfter {
+			delete(c.last, id)
+		}
+	}
+	return kept, duplicates
 }
 
 // SnapshotFile is the JSON written to snapshots/YYYY/MM/DD/HHMMSS.json
@@ -72,6 +176,8 @@ type TodaySummary struct {
 	UpdatedAt          string           `json:"updatedAt"`
 	Date               string           `json:"date"`
 	PositionsCollected int64            `json:"positionsCollected"`
+	DuplicatePositions int64            `json:"duplicatePositions"`
+	CycleDuplicates    int              `json:"cycleDuplicates"`
 	ActiveVehicles     int              `json:"activeVehicles"`
 	ActiveRoutes       int              `json:"activeRoutes"`
 	AvgSpeed           *float64         `json:"avgSpeed"`
@@ -96,6 +202,8 @@ type rollingState struct {
 	mu                 sync.Mutex
 	date               string
 	positionsCollected int64
+	duplicatePositions int64
+	cycleDuplicates    int
 	vehicles           map[string]struct{}
 	routes             map[string]struct{}
 	speedSum           float64
@@ -111,6 +219,8 @@ var state = &rollingState{}
 func (s *rollingState) reset(date string) {
 	s.date = date
 	s.positionsCollected = 0
+	s.duplicatePositions = 0
+	s.cycleDuplicates = 0
 	s.vehicles = make(map[string]struct{})
 	s.routes = make(map[string]struct{})
 	s.speedSum = 0
@@ -123,7 +233,10 @@ func (s *rollingState) reset(date string) {
 	}
 }
 
-func (s *rollingState) ingest(rows []*positionRow, now time.Time) {
+// ingest adds a cycle's rows to today's totals. Stale and duplicate rows are
+// not counted as collected; duplicates is the cycle's duplicate count, which
+// includes rows the dedup cache already dropped.
+func (s *rollingState) ingest(rows []*positionRow, duplicates int, now time.Time) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -133,9 +246,14 @@ func (s *rollingState) ingest(rows []*positionRow, now time.Time) {
 	}
 
 	h := now.UTC().Hour()
-	s.positionsCollected += int64(len(rows))
+	s.duplicatePositions += int64(duplicates)
+	s.cycleDuplicates = duplicates
 
 	for _, r := range rows {
+		if r.stale || r.duplicate {
+			continue
+		}
+		s.positionsCollected++
 		s.vehicles[r.vehicleID] = struct{}{}
 		if r.route != nil {
 			s.routes[*r.route] = struct{}{}
@@ -184,6 +302,8 @@ func (s *rollingState) summary(now time.Time) TodaySummary {
 		UpdatedAt:          now.UTC().Format(time.RFC3339),
 		Date:               s.date,
 		PositionsCollected: s.positionsCollected,
+		DuplicatePositions: s.duplicatePositions,
+		CycleDuplicates:    s.cycleDuplicates,
 		ActiveVehicles:     len(s.vehicles),
 		ActiveRoutes:       len(s.routes),
 		AvgSpeed:           avgSpeed,
@@ -192,287 +312,39 @@ func (s *rollingState) summary(now time.Time) TodaySummary {
 	}
 }
 
-// unwrapString extracts a string from either "value" or a raw string JSON value
-func unwrapString(raw json.RawMessage) string {
-	if len(raw) == 0 {
-		return ""
-	}
-	var obj struct {
-		Value string `json:"value"`
-	}
-	if err := json.Unmarshal(raw, &obj); err == nil && obj.Value != "" {
-		return obj.Value
-	}
-	var s string
-	if err := json.Unmarshal(raw, &s); err == nil {
-		return s
-	}
-	return ""
-}
-
-// unwrapFloat64 extracts a float64 from either {"value": N} or raw number
-func unwrapFloat64(raw json.RawMessage) (float64, bool) {
-	if len(raw) == 0 {
-		return 0, false
-	}
-	var obj struct {
-		Value *float64 `json:"value"`
-	}
-	if err := json.Unmarshal(raw, &obj); err == nil && obj.Value != nil {
-		return *obj.Value, true
-	}
-	var f float64
-	if err := json.Unmarshal(raw, &f); err == nil {
-		return f, true
-	}
-	return 0, false
-}
-
-// unwrapLocation extracts [lon, lat] coordinates from FIWARE location
-func unwrapLocation(raw json.RawMessage) (lon, lat float64, ok bool) {
-	if len(raw) == 0 {
-		return 0, 0, false
-	}
-	var nested struct {
-		Value struct {
-			Coordinates [2]float64 `json:"coordinates"`
-		} `json:"value"`
-	}
-	if err := json.Unmarshal(raw, &nested); err == nil && (nested.Value.Coordinates[0] != 0 || nested.Value.Coordinates[1] != 0) {
-		return nested.Value.Coordinates[0], nested.Value.Coordinates[1], true
-	}
-	var direct struct {
-		Coordinates [2]float64 `json:"coordinates"`
-	}
-	if err := json.Unmarshal(raw, &direct); err == nil && (direct.Coordinates[0] != 0 || direct.Coordinates[1] != 0) {
-		return direct.Coordinates[0], direct.Coordinates[1], true
-	}
-	return 0, 0, false
-}
-
-// unwrapAnnotations extracts string array from FIWARE annotations
-func unwrapAnnotations(raw json.RawMessage) []string {
-	if len(raw) == 0 {
-		return nil
-	}
-	var obj struct {
-		Value []string `json:"value"`
-	}
-	if err := json.Unmarshal(raw, &obj); err == nil && len(obj.Value) > 0 {
-		return obj.Value
-	}
-	var arr []string
-	if err := json.Unmarshal(raw, &arr); err == nil {
-		return arr
-	}
-	return nil
-}
-
-var routePartRegex = regexp.MustCompile(`^[A-Za-z0-9]{1,4}$`)
-var stcpRegex = regexp.MustCompile(`(?i)STCP\s+(\d+)`)
-
-func parseEntity(entity *fiwareEntity) *positionRow {
-	lon, lat, ok := unwrapLocation(entity.Location)
-	if !ok {
-		return nil
-	}
-
-	var route string
-	if rsn := unwrapString(entity.RouteShortName); rsn != "" {
-		route = rsn
-	} else if rte := unwrapString(entity.Route); rte != "" {
-		route = rte
-	} else if lid := unwrapString(entity.LineID); lid != "" {
-		route = lid
-	} else if lin := unwrapString(entity.Line); lin != "" {
-		route = lin
-	} else {
-		vehicleID := unwrapString(entity.VehiclePlateIdentifier)
-		if vehicleID == "" {
-			vehicleID = unwrapString(entity.VehicleNumber)
-		}
-		if vehicleID == "" {
-			vehicleID = unwrapString(entity.LicensePlate)
-		}
-		if vehicleID == "" {
-			vehicleID = unwrapString(entity.Name)
-		}
-		if vehicleID != "" {
-			if m := stcpRegex.FindStringSubmatch(vehicleID); len(m) > 1 {
-				route = m[1]
-			}
-		}
-		if route == "" && entity.ID != "" {
-			parts := strings.Split(entity.ID, ":")
-			for i := 2; i < len(parts)-1; i++ {
-				p := parts[i]
-				if p != "" && p != "Vehicle" && p != "porto" && p != "stcp" && routePartRegex.MatchString(p) {
-					route = p
-					break
-				}
-			}
-			if route == "" && len(parts) >= 4 {
-				candidate := parts[len(parts)-2]
-				if candidate != "" && candidate != "Vehicle" && candidate != "stcp" {
-					route = candidate
-				}
-			}
-		}
-	}
-
-	var directionID *int16
-	var tripID *string
-	annotations := unwrapAnnotations(entity.Annotations)
-	for _, ann := range annotations {
-		if strings.HasPrefix(ann, "stcp:sentido:") {
-			var d int16
-			if _, err := fmt.Sscanf(ann, "stcp:sentido:%d", &d); err == nil {
-				directionID = &d
-			}
-		} else if strings.HasPrefix(ann, "stcp:nr_viagem:") {
-			t := strings.TrimPrefix(ann, "stcp:nr_viagem:")
-			tripID = &t
-		}
-	}
-
-	var vehicleNum *string
-	rawVehicleNum := unwrapString(entity.VehiclePlateIdentifier)
-	if rawVehicleNum == "" {
-		rawVehicleNum = unwrapString(entity.VehicleNumber)
-	}
-	if rawVehicleNum == "" {
-		rawVehicleNum = unwrapString(entity.LicensePlate)
-	}
-	if rawVehicleNum == "" {
-		rawVehicleNum = unwrapString(entity.Name)
-	}
-	if rawVehicleNum == "" {
-		parts := strings.Split(entity.ID, ":")
-		if len(parts) > 0 {
-			rawVehicleNum = parts[len(parts)-1]
-		}
-	}
-	if rawVehicleNum != "" {
-		parts := strings.Fields(rawVehicleNum)
-		last := parts[len(parts)-1]
-		isDigits := true
-		for _, c := range last {
-			if c < '0' || c > '9' {
-				isDigits = false
-				break
-			}
-		}
-		if isDigits && last != "" {
-			vehicleNum = &last
-		} else {
-			vehicleNum = &rawVehicleNum
-		}
-	}
-
-	var speed *float32
-	if s, ok := unwrapFloat64(entity.Speed); ok {
-		f := float32(s)
-		speed = &f
-	}
-	var heading *float32
-	if h, ok := unwrapFloat64(entity.Heading); ok {
-		f := float32(h)
-		heading = &f
-	} else if b, ok := unwrapFloat64(entity.Bearing); ok {
-		f := float32(b)
-		heading = &f
-	}
-
-	var routePtr *string
-	if route != "" {
-		routePtr = &route
-	}
-
-	return &positionRow{
-		vehicleID:   entity.ID,
-		vehicleNum:  vehicleNum,
-		route:       routePtr,
-		tripID:      tripID,
-		directionID: directionID,
-		lat:         lat,
-		lon:         lon,
-		speed:       speed,
-		heading:     heading,
-	}
-}
-
-func collectPositions(ctx context.Context, r2 *s3.Client, bucket string) (int, error) {
+func collectPositions(ctx context.Context, src FeedSource, store objectStore, snapshots *snapshotWriter) (int, error) {
 	now := time.Now().UTC()
 
-	req, err := http.NewRequestWithContext(ctx, "GET", fiwareURL, nil)
-	if err != nil {
-		return 0, fmt.Errorf("create request: %w", err)
-	}
-	req.Header.Set("User-Agent", "PortoMove-Collector/2.0")
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Cache-Control", "no-cache")
-
-	client := &http.Client{Timeout: 15 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return 0, fmt.Errorf("FIWARE fetch: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("FIWARE HTTP %d %s", resp.StatusCode, resp.Status)
-	}
-
-	body, err := io.ReadAll(resp.Body)
+	rows, err := src.Fetch(ctx)
 	if err != nil {
-		return 0, fmt.Errorf("read response: %w", err)
-	}
-
-	var entities []fiwareEntity
-	if err := json.Unmarshal(body, &entities); err != nil {
-		return 0, fmt.Errorf("parse FIWARE JSON: %w", err)
+		return 0, err
 	}
 
-	if len(entities) == 0 {
-		return 0, fmt.Errorf("FIWARE returned empty response")
+	rows, staleCount := staleness.apply(rows, now)
+	if staleCount > 0 {
+		logger(ctx).Info("stale positions", "count", staleCount, "maxAge", staleness.maxAge, "mode", staleness.mode)
 	}
+	rows, dupCount := dedup.apply(rows, now)
+	positionsFiltered.WithLabelValues("stale").Add(float64(staleCount))
+	positionsFiltered.WithLabelValues("duplicate").Add(float64(dupCount))
 
-	rows := make([]*positionRow, 0, len(entities))
-	for i := range entities {
-		if entities[i].ID == "" {
-			continue
-		}
-		if row := parseEntity(&entities[i]); row != nil {
-			rows = append(rows, row)
+	active := 0
+	for _, r := range rows {
+		if !r.stale {
+			active++
 		}
 	}
+	activeVehicles.Set(float64(active))
 
 	if len(rows) == 0 {
-		log.Println("[collect] No valid positions parsed from FIWARE response")
+		logger(ctx).Warn("no valid positions parsed", "source", src.Name())
 		return 0, nil
 	}
 
 	// Build snapshot positions
 	positions := make([]SnapshotPosition, 0, len(rows))
 	for _, r := range rows {
-		sp := SnapshotPosition{
-			VehicleID:   r.vehicleID,
-			DirectionID: r.directionID,
-			Lat:         r.lat,
-			Lon:         r.lon,
-			Speed:       r.speed,
-			Heading:     r.heading,
-		}
-		if r.vehicleNum != nil {
-			sp.VehicleNum = *r.vehicleNum
-		}
-		if r.route != nil {
-			sp.Route = *r.route
-		}
-		if r.tripID != nil {
-			sp.TripID = *r.tripID
-		}
-		positions = append(positions, sp)
+		positions = append(positions, newSnapshotPosition(r))
 	}
 
 	snapshot := SnapshotFile{
@@ -480,26 +352,25 @@ func collectPositions(ctx context.Context, r2 *s3.Client, bucket string) (int, e
 		Positions:  positions,
 	}
 
-	snapshotJSON, err := json.Marshal(snapshot)
-	if err != nil {
-		return 0, fmt.Errorf("marshal snapshot: %w", err)
+	if err := snapshots.write(ctx, &snapshot, now); err != nil {
+		return 0, err
 	}
 
-	// Write per-cycle snapshot: snapshots/YYYY/MM/DD/HHMMSS.json
-	snapshotKey := fmt.Sprintf("snapshots/%04d/%02d/%02d/%s.json",
-		now.Year(), now.Month(), now.Day(), now.Format("150405"))
-	contentType := "application/json"
-	if _, err := r2.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:      &bucket,
-		Key:         &snapshotKey,
-		Body:        bytes.NewReader(snapshotJSON),
-		ContentType: &contentType,
-	}); err != nil {
-		return 0, fmt.Errorf("write snapshot to R2: %w", err)
+	// Publish the same cycle as a GTFS-RT VehiclePositions feed
+	if feedPB, err := encodeVehiclePositions(rows, now); err != nil {
+		logger(ctx).Warn("failed to encode GTFS-RT feed", "error", err)
+	} else {
+		putStart := time.Now()
+		err := store.Put(ctx, gtfsrtFeedKey, feedPB, putOptions{ContentType: "application/x-protobuf"})
+		observeR2Put("gtfsrt", putStart, err)
+		if err != nil {
+			// Non-fatal like today.json: the snapshot is the source of truth
+			logger(ctx).Warn("failed to update GTFS-RT feed", "key", gtfsrtFeedKey, "error", err)
+		}
 	}
 
 	// Update rolling state and overwrite today.json
-	state.ingest(rows, now)
+	state.ingest(rows, dupCount, now)
 	summary := state.summary(now)
 
 	summaryJSON, err := json.Marshal(summary)
@@ -507,15 +378,12 @@ func collectPositions(ctx context.Context, r2 *s3.Client, bucket string) (int, e
 		return len(rows), fmt.Errorf("marshal today summary: %w", err)
 	}
 
-	todayKey := "snapshots/today.json"
-	if _, err := r2.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:      &bucket,
-		Key:         &todayKey,
-		Body:        bytes.NewReader(summaryJSON),
-		ContentType: &contentType,
-	}); err != nil {
+	putStart := time.Now()
+	err = store.Put(ctx, "snapshots/today.json", summaryJSON, putOptions{ContentType: "application/json"})
+	observeR2Put("today", putStart, err)
+	if err != nil {
 		// Non-fatal: snapshot was written, today.json is best-effort
-		log.Printf("[collect] WARNING: failed to update today.json: %v", err)
+		logger(ctx).Warn("failed to update today.json", "error", err)
 	}
 
 	return len(rows), nil
@@ -4,52 +4,27 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
-	"log"
 	"math"
 	"sort"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 const aggregateChunkSize = 5000
 
-// listSnapshotKeys returns all snapshot keys for a given date from R2.
-func listSnapshotKeys(ctx context.Context, r2 *s3.Client, bucket, dateStr string) ([]string, error) {
+// listSnapshotKeys returns all snapshot keys for a given date.
+func listSnapshotKeys(ctx context.Context, store objectStore, dateStr string) ([]string, error) {
 	prefix := fmt.Sprintf("snapshots/%s/", strings.ReplaceAll(dateStr, "-", "/"))
-	var keys []string
-	var continuationToken *string
-
-	for {
-		out, err := r2.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
-			Bucket:            &bucket,
-			Prefix:            &prefix,
-			ContinuationToken: continuationToken,
-		})
-		if err != nil {
-			return nil, fmt.Errorf("list R2 objects: %w", err)
-		}
-		for _, obj := range out.Contents {
-			if obj.Key != nil {
-				keys = append(keys, *obj.Key)
-			}
-		}
-		if out.IsTruncated == nil || !*out.IsTruncated {
-			break
-		}
-		continuationToken = out.NextContinuationToken
-	}
-	return keys, nil
+	return store.List(ctx, prefix)
 }
 
-func runAggregateDaily(ctx context.Context, pool *pgxpool.Pool, r2 *s3.Client, bucket string) error {
-	return runAggregateDailyWithDate(ctx, pool, r2, bucket, time.Time{})
+func runAggregateDaily(ctx context.Context, pool *pgxpool.Pool, store objectStore) error {
+	return runAggregateDailyWithDate(ctx, pool, store, time.Time{})
 }
 
-func runAggregateDailyWithDate(ctx context.Context, pool *pgxpool.Pool, r2 *s3.Client, bucket string, overrideDate time.Time) error {
+func runAggregateDailyWithDate(ctx context.Context, pool *pgxpool.Pool, store objectStore, overrideDate time.Time) error {
 	startTime := time.Now()
 
 	now := time.Now().UTC()
@@ -66,18 +41,18 @@ func runAggregateDailyWithDate(ctx context.Context, pool *pgxpool.Pool, r2 *s3.C
 		dateStr = yesterday.Format("2006-01-02")
 	}
 
-	log.Printf("[aggregate] Starting for %s", dateStr)
+	logger(ctx).Info("aggregate starting", "date", dateStr)
 
 	// List snapshot files for yesterday from R2
-	keys, err := listSnapshotKeys(ctx, r2, bucket, dateStr)
+	keys, err := listSnapshotKeys(ctx, store, dateStr)
 	if err != nil {
 		return fmt.Errorf("list snapshots: %w", err)
 	}
 	if len(keys) == 0 {
-		log.Printf("[aggregate] No snapshots found for %s", dateStr)
+		logger(ctx).Info("no snapshots found", "date", dateStr)
 		return nil
 	}
-	log.Printf("[aggregate] Found %d snapshot files for %s", len(keys), dateStr)
+	logger(ctx).Info("snapshot files found", "date", dateStr, "files", len(keys))
 
 	// Pre-load segments
 	segRows, err := pool.Query(ctx, `SELECT id, route, "directionId", "segmentIndex", "startLat", "startLon", "endLat", "endLon", "midLat", "midLon", "lengthM", geometry FROM "RouteSegment"`)
@@ -133,100 +108,88 @@ func runAggregateDailyWithDate(ctx context.Context, pool *pgxpool.Pool, r2 *s3.C
 	lastSeenAt := make(map[string]int64)
 
 	for _, key := range keys {
-		out, err := r2.GetObject(ctx, &s3.GetObjectInput{Bucket: &bucket, Key: &key})
-		if err != nil {
-			log.Printf("[aggregate] WARNING: failed to fetch %s: %v", key, err)
-			continue
-		}
-		body, err := io.ReadAll(out.Body)
-		out.Body.Close()
+		snaps, err := readSnapshots(ctx, store, key)
 		if err != nil {
-			log.Printf("[aggregate] WARNING: failed to read %s: %v", key, err)
-			continue
-		}
-
-		var snap SnapshotFile
-		if err := json.Unmarshal(body, &snap); err != nil {
-			log.Printf("[aggregate] WARNING: failed to parse %s: %v", key, err)
+			logger(ctx).Warn("failed to read snapshot", "key", key, "error", err)
 			continue
 		}
-
-		recordedAt, err := time.Parse(time.RFC3339, snap.RecordedAt)
-		if err != nil {
-			continue
-		}
-
-		for _, p := range snap.Positions {
-			if p.Route == "" {
+		for _, snap := range snaps {
+			recordedAt, err := time.Parse(time.RFC3339, snap.RecordedAt)
+			if err != nil {
 				continue
 			}
-			pp := PositionPoint{
-				RecordedAt: recordedAt,
-				VehicleID:  p.VehicleID,
-				Route:      p.Route,
-				Lat:        p.Lat,
-				Lon:        p.Lon,
-				Speed:      p.Speed,
-			}
-			if p.VehicleNum != "" {
-				pp.VehicleNum = &p.VehicleNum
-			}
-			if p.TripID != "" {
-				pp.TripID = &p.TripID
-			}
-			pp.DirectionID = p.DirectionID
 
-			r := pp.Route
-			dirStr := "x"
-			if pp.DirectionID != nil {
-				dirStr = fmt.Sprintf("%d", *pp.DirectionID)
-			}
-			vKey := pp.VehicleID + ":" + r + ":" + dirStr
-			vehicleGroups[vKey] = append(vehicleGroups[vKey], pp)
+			for _, p := range snap.Positions {
+				if p.Route == "" || p.Stale || p.Duplicate {
+					continue
+				}
+				pp := PositionPoint{
+					RecordedAt: p.positionTime(recordedAt),
+					VehicleID:  p.VehicleID,
+					Route:      p.Route,
+					Lat:        p.Lat,
+					Lon:        p.Lon,
+					Speed:      p.Speed,
+				}
+				if p.VehicleNum != "" {
+					pp.VehicleNum = &p.VehicleNum
+				}
+				if p.TripID != "" {
+					pp.TripID = &p.TripID
+				}
+				pp.DirectionID = p.DirectionID
 
-			if pp.Speed != nil && *pp.Speed > 0 && len(segDefs) > 0 {
-				segID := snapToSegment(pp.Lat, pp.Lon, r, pp.DirectionID, segDefs, 150)
-				if segID != "" {
-					hour := time.Date(pp.RecordedAt.Year(), pp.RecordedAt.Month(), pp.RecordedAt.Day(), pp.RecordedAt.Hour(), 0, 0, 0, time.UTC)
-					key := segID + ":" + hour.Format(time.RFC3339)
-					hourlySegmentSpeeds[key] = append(hourlySegmentSpeeds[key], float64(*pp.Speed))
+				r := pp.Route
+				dirStr := "x"
+				if pp.DirectionID != nil {
+					dirStr = fmt.Sprintf("%d", *pp.DirectionID)
 				}
-			}
+				vKey := pp.VehicleID + ":" + r + ":" + dirStr
+				vehicleGroups[vKey] = append(vehicleGroups[vKey], pp)
 
-			stopsForRoute := stopsByRoute[r]
-			if len(stopsForRoute) > 0 {
-				var bestStop *routeStop
-				bestDist := math.Inf(1)
-				for i := range stopsForRoute {
-					rs := &stopsForRoute[i]
-					if pp.DirectionID != nil && rs.DirectionID != int(*pp.DirectionID) {
-						continue
-					}
-					dist := haversineM(pp.Lat, pp.Lon, rs.Lat, rs.Lon)
-					if dist < bestDist && dist <= 80 {
-						bestDist = dist
-						bestStop = rs
+				if pp.Speed != nil && *pp.Speed > 0 && len(segDefs) > 0 {
+					segID := snapToSegment(pp.Lat, pp.Lon, r, pp.DirectionID, segDefs, 150)
+					if segID != "" {
+						hour := time.Date(pp.RecordedAt.Year(), pp.RecordedAt.Month(), pp.RecordedAt.Day(), pp.RecordedAt.Hour(), 0, 0, 0, time.UTC)
+						key := segID + ":" + hour.Format(time.RFC3339)
+						hourlySegmentSpeeds[key] = append(hourlySegmentSpeeds[key], float64(*pp.Speed))
 					}
 				}
-				if bestStop != nil {
-					stopKey := r + ":" + dirStr + ":" + bestStop.StopID
-					dedupeKey := pp.VehicleID + ":" + stopKey
-					ts := pp.RecordedAt.UnixMilli()
-					last, exists := lastSeenAt[dedupeKey]
-					if !exists || ts-last >= 3*60*1000 {
-						lastSeenAt[dedupeKey] = ts
-						stopArrivals[stopKey] = append(stopArrivals[stopKey], ts)
+
+				stopsForRoute := stopsByRoute[r]
+				if len(stopsForRoute) > 0 {
+					var bestStop *routeStop
+					bestDist := math.Inf(1)
+					for i := range stopsForRoute {
+						rs := &stopsForRoute[i]
+						if pp.DirectionID != nil && rs.DirectionID != int(*pp.DirectionID) {
+							continue
+						}
+						dist := haversineM(pp.Lat, pp.Lon, rs.Lat, rs.Lon)
+						if dist < bestDist && dist <= 80 {
+							bestDist = dist
+							bestStop = rs
+						}
+					}
+					if bestStop != nil {
+						stopKey := r + ":" + dirStr + ":" + bestStop.StopID
+						dedupeKey := pp.VehicleID + ":" + stopKey
+						ts := pp.RecordedAt.UnixMilli()
+						last, exists := lastSeenAt[dedupeKey]
+						if !exists || ts-last >= 3*60*1000 {
+							lastSeenAt[dedupeKey] = ts
+							stopArrivals[stopKey] = append(stopArrivals[stopKey], ts)
+						}
 					}
 				}
+				totalPositions++
 			}
-			totalPositions++
+			// Free memory immediately after processing each snapshot
+			snap.Positions = nil
 		}
-		// Free memory immediately after processing each snapshot
-		body = nil
-		snap.Positions = nil
 	}
 
-	log.Printf("[aggregate] Processed %d positions from %d files", totalPositions, len(keys))
+	logger(ctx).Info("positions processed", "positions", totalPositions, "files", len(keys))
 
 	// Trip reconstruction
 	var allTrips []ReconstructedTrip
@@ -268,7 +231,7 @@ func runAggregateDailyWithDate(ctx context.Context, pool *pgxpool.Pool, r2 *s3.C
 			}
 		}
 	}
-	log.Printf("[aggregate] Reconstructed %d trips", len(allTrips))
+	logger(ctx).Info("trips reconstructed", "trips", len(allTrips))
 
 	// Segment speed aggregation
 	if len(segDefs) > 0 && len(hourlySegmentSpeeds) > 0 {
@@ -355,7 +318,7 @@ func runAggregateDailyWithDate(ctx context.Context, pool *pgxpool.Pool, r2 *s3.C
 				return fmt.Errorf("insert segment speeds: %w", err)
 			}
 		}
-		log.Printf("[aggregate] Computed %d segment speed aggregates", len(segSpeedRows))
+		logger(ctx).Info("segment speeds computed", "rows", len(segSpeedRows))
 	}
 
 	// Route performance daily
@@ -470,7 +433,7 @@ func runAggregateDailyWithDate(ctx context.Context, pool *pgxpool.Pool, r2 *s3.C
 			}
 		}
 	}
-	log.Printf("[aggregate] Computed performance for %d route-directions", len(routePerfRows))
+	logger(ctx).Info("route performance computed", "routeDirections", len(routePerfRows))
 
 	// Stop headway irregularity
 	if len(stopArrivals) > 0 {
@@ -561,7 +524,7 @@ func runAggregateDailyWithDate(ctx context.Context, pool *pgxpool.Pool, r2 *s3.C
 				return fmt.Errorf("insert stop headway: %w", err)
 			}
 		}
-		log.Printf("[aggregate] Computed headway irregularity for %d stops", len(headwayRows))
+		logger(ctx).Info("headway irregularity computed", "stops", len(headwayRows))
 	}
 
 	// Network summary
@@ -621,6 +584,6 @@ func runAggregateDailyWithDate(ctx context.Context, pool *pgxpool.Pool, r2 *s3.C
 	}
 
 	elapsed := time.Since(startTime)
-	log.Printf("[aggregate] Complete for %s: %d positions, %d trips in %s", dateStr, totalPositions, len(allTrips), elapsed)
+	logger(ctx).Info("aggregate complete", "date", dateStr, "positions", totalPositions, "trips", len(allTrips), "duration", elapsed)
 	return nil
 }
@@ -4,37 +4,124 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
-	"log"
 	"math"
 	"sort"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-const snapshotBatchSize = 500
+// snapshotBatchCycles is how many snapshot cycles' positions make one batch,
+// however many files they are spread over.
+const snapshotBatchCycles = 500
+
+// positionInput feeds one day of positions to aggregateDay in batches.
+type positionInput interface {
+	// Describe names the input in logs.
+	Describe() string
+	// Batches calls fn with successive batches of positions. Positions
+	// without a route, and stale or duplicate positions, are already skipped.
+	Batches(ctx context.Context, fn func(batch []PositionPoint) error) error
+}
 
-func runAggregateDailyIncremental(ctx context.Context, pool *pgxpool.Pool, r2 *s3.Client, bucket string, overrideDate time.Time) error {
-	startTime := time.Now()
+// snapshotInput reads a day's raw snapshots/ files from the store,
+// snapshotBatchCycles cycles per batch.
+type snapshotInput struct {
+	store objectStore
+	keys  []string
+}
 
-	now := time.Now().UTC()
-	var yesterday, today time.Time
-	var dateStr string
+func (in *snapshotInput) Describe() string {
+	return fmt.Sprintf("%d snapshot files", len(in.keys))
+}
+
+func (in *snapshotInput) Batches(ctx context.Context, fn func(batch []PositionPoint) error) error {
+	var batchPositions []PositionPoint
+	cycles := 0
+	for _, key := range in.keys {
+		snaps, err := readSnapshots(ctx, in.store, key)
+		if err != nil {
+			logger(ctx).Warn("failed to read snapshot", "key", key, "error", err)
+			continue
+		}
+		for _, snap := range snaps {
+			recordedAt, err := time.Parse(time.RFC3339, snap.RecordedAt)
+			if err != nil {
+				continue
+			}
+
+			for _, p := range snap.Positions {
+				if p.Route == "" || p.Stale || p.Duplicate {
+					continue
+				}
+				pp := PositionPoint{
+					RecordedAt: p.positionTime(recordedAt),
+					VehicleID:  p.VehicleID,
+					Route:      p.Route,
+					Lat:        p.Lat,
+					Lon:        p.Lon,
+					Speed:      p.Speed,
+				}
+				if p.VehicleNum != "" {
+					pp.VehicleNum = &p.VehicleNum
+				}
+				if p.TripID != "" {
+					pp.TripID = &p.TripID
+				}
+				pp.DirectionID = p.DirectionID
 
+				batchPositions = append(batchPositions, pp)
+			}
+
+			cycles++
+			if cycles == snapshotBatchCycles {
+				if err := fn(batchPositions); err != nil {
+					return err
+				}
+				batchPositions, cycles = nil, 0
+			}
+		}
+	}
+	if cycles > 0 {
+		return fn(batchPositions)
+	}
+	return nil
+}
+
+func runAggregateDailyIncremental(ctx context.Context, pool *pgxpool.Pool, store objectStore, overrideDate time.Time) error {
+	now := time.Now().UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, time.UTC)
 	if !overrideDate.IsZero() {
-		yesterday = time.Date(overrideDate.Year(), overrideDate.Month(), overrideDate.Day(), 0, 0, 0, 0, time.UTC)
-		today = yesterday.AddDate(0, 0, 1)
-		dateStr = yesterday.Format("2006-01-02")
-	} else {
-		yesterday = time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, time.UTC)
-		today = yesterday.AddDate(0, 0, 1)
-		dateStr = yesterday.Format("2006-01-02")
+		day = time.Date(overrideDate.Year(), overrideDate.Month(), overrideDate.Day(), 0, 0, 0, 0, time.UTC)
 	}
+	dateStr := day.Format("2006-01-02")
 
-	log.Printf("[aggregate] Starting incremental aggregation for %s", dateStr)
+	// List snapshot files
+	keys, err := listSnapshotKeys(ctx, store, dateStr)
+	if err != nil {
+		return fmt.Errorf("list snapshots: %w", err)
+	}
+	if len(keys) == 0 {
+		logger(ctx).Info("no snapshots found", "date", dateStr)
+		return nil
+	}
+	logger(ctx).Info("snapshot files found", "date", dateStr, "files", len(keys))
+
+	return aggregateDay(ctx, pool, day, &snapshotInput{store: store, keys: keys})
+}
+
+// aggregateDay rebuilds TripLog, SegmentSpeedHourly, RoutePerformanceDaily,
+// StopHeadwayDaily and NetworkSummaryDaily for day (UTC midnight) from input.
+// Existing rows for the day are replaced.
+func aggregateDay(ctx context.Context, pool *pgxpool.Pool, day time.Time, input positionInput) error {
+	startTime := time.Now()
+
+	yesterday := day
+	today := yesterday.AddDate(0, 0, 1)
+	dateStr := yesterday.Format("2006-01-02")
+
+	logger(ctx).Info("incremental aggregation starting", "date", dateStr, "input", input.Describe())
 
 	// Create temporary staging table for positions
 	_, err := pool.Exec(ctx, `
@@ -62,17 +149,6 @@ func runAggregateDailyIncremental(ctx context.Context, pool *pgxpool.Pool, r2 *s
 		return fmt.Errorf("truncate staging: %w", err)
 	}
 
-	// List snapshot files
-	keys, err := listSnapshotKeys(ctx, r2, bucket, dateStr)
-	if err != nil {
-		return fmt.Errorf("list snapshots: %w", err)
-	}
-	if len(keys) == 0 {
-		log.Printf("[aggregate] No snapshots found for %s", dateStr)
-		return nil
-	}
-	log.Printf("[aggregate] Found %d snapshot files", len(keys))
-
 	// Pre-load segments
 	segRows, err := pool.Query(ctx, `SELECT id, route, "directionId", "segmentIndex", "startLat", "startLon", "endLat", "endLon", "midLat", "midLon", "lengthM", geometry FROM "RouteSegment"`)
 	if err != nil {
@@ -119,153 +195,96 @@ func runAggregateDailyIncremental(ctx context.Context, pool *pgxpool.Pool, r2 *s
 	}
 	rsRows.Close()
 
-	// Process snapshots in batches
+	// Process positions in batches
 	var totalPositions int64
 	hourlySegmentSpeeds := make(map[string][]float64)
 	stopArrivals := make(map[string][]int64)
 	lastSeenAt := make(map[string]int64)
 
 	batchNum := 0
-	for batchStart := 0; batchStart < len(keys); batchStart += snapshotBatchSize {
-		batchEnd := batchStart + snapshotBatchSize
-		if batchEnd > len(keys) {
-			batchEnd = len(keys)
-		}
+	err = input.Batches(ctx, func(batchPositions []PositionPoint) error {
 		batchNum++
 
-		// Process each snapshot in this batch
-		var batchPositions []PositionPoint
-		for _, key := range keys[batchStart:batchEnd] {
-			out, err := r2.GetObject(ctx, &s3.GetObjectInput{Bucket: &bucket, Key: &key})
-			if err != nil {
-				log.Printf("[aggregate] WARNING: failed to fetch %s: %v", key, err)
-				continue
-			}
-			body, err := io.ReadAll(out.Body)
-			out.Body.Close()
-			if err != nil {
-				log.Printf("[aggregate] WARNING: failed to read %s: %v", key, err)
-				continue
-			}
-
-			var snap SnapshotFile
-			if err := json.Unmarshal(body, &snap); err != nil {
-				log.Printf("[aggregate] WARNING: failed to parse %s: %v", key, err)
-				continue
-			}
-
-			recordedAt, err := time.Parse(time.RFC3339, snap.RecordedAt)
-			if err != nil {
-				continue
-			}
-
-			for _, p := range snap.Positions {
-				if p.Route == "" {
-					continue
-				}
-				pp := PositionPoint{
-					RecordedAt: recordedAt,
-					VehicleID:  p.VehicleID,
-					Route:      p.Route,
-					Lat:        p.Lat,
-					Lon:        p.Lon,
-					Speed:      p.Speed,
+		for _, pp := range batchPositions {
+			// Segment speeds (keep in memory - small)
+			if pp.Speed != nil && *pp.Speed > 0 && len(segDefs) > 0 {
+				segID := snapToSegment(pp.Lat, pp.Lon, pp.Route, pp.DirectionID, segDefs, 150)
+				if segID != "" {
+					hour := time.Date(pp.RecordedAt.Year(), pp.RecordedAt.Month(), pp.RecordedAt.Day(), pp.RecordedAt.Hour(), 0, 0, 0, time.UTC)
+					key := segID + ":" + hour.Format(time.RFC3339)
+					hourlySegmentSpeeds[key] = append(hourlySegmentSpeeds[key], float64(*pp.Speed))
 				}
-				if p.VehicleNum != "" {
-					pp.VehicleNum = &p.VehicleNum
-				}
-				if p.TripID != "" {
-					pp.TripID = &p.TripID
-				}
-				pp.DirectionID = p.DirectionID
-
-				batchPositions = append(batchPositions, pp)
+			}
 
-				// Segment speeds (keep in memory - small)
-				if pp.Speed != nil && *pp.Speed > 0 && len(segDefs) > 0 {
-					segID := snapToSegment(pp.Lat, pp.Lon, pp.Route, pp.DirectionID, segDefs, 150)
-					if segID != "" {
-						hour := time.Date(pp.RecordedAt.Year(), pp.RecordedAt.Month(), pp.RecordedAt.Day(), pp.RecordedAt.Hour(), 0, 0, 0, time.UTC)
-						key := segID + ":" + hour.Format(time.RFC3339)
-						hourlySegmentSpeeds[key] = append(hourlySegmentSpeeds[key], float64(*pp.Speed))
+			// Stop arrivals (keep in memory - small)
+			stopsForRoute := stopsByRoute[pp.Route]
+			if len(stopsForRoute) > 0 {
+				var bestStop *routeStop
+				bestDist := math.Inf(1)
+				for i := range stopsForRoute {
+					rs := &stopsForRoute[i]
+					if pp.DirectionID != nil && rs.DirectionID != int(*pp.DirectionID) {
+						continue
+					}
+					dist := haversineM(pp.Lat, pp.Lon, rs.Lat, rs.Lon)
+					if dist < bestDist && dist <= 80 {
+						bestDist = dist
+						bestStop = rs
 					}
 				}
-
-				// Stop arrivals (keep in memory - small)
-				stopsForRoute := stopsByRoute[pp.Route]
-				if len(stopsForRoute) > 0 {
-					var bestStop *routeStop
-					bestDist := math.Inf(1)
-					for i := range stopsForRoute {
-						rs := &stopsForRoute[i]
-						if pp.DirectionID != nil && rs.DirectionID != int(*pp.DirectionID) {
-							continue
-						}
-						dist := haversineM(pp.Lat, pp.Lon, rs.Lat, rs.Lon)
-						if dist < bestDist && dist <= 80 {
-							bestDist = dist
-							bestStop = rs
-						}
+				if bestStop != nil {
+					dirStr := "x"
+					if pp.DirectionID != nil {
+						dirStr = fmt.Sprintf("%d", *pp.DirectionID)
 					}
-					if bestStop != nil {
-						dirStr := "x"
-						if pp.DirectionID != nil {
-							dirStr = fmt.Sprintf("%d", *pp.DirectionID)
-						}
-						stopKey := pp.Route + ":" + dirStr + ":" + bestStop.StopID
-						dedupeKey := pp.VehicleID + ":" + stopKey
-						ts := pp.RecordedAt.UnixMilli()
-						last, exists := lastSeenAt[dedupeKey]
-						if !exists || ts-last >= 3*60*1000 {
-							lastSeenAt[dedupeKey] = ts
-							stopArrivals[stopKey] = append(stopArrivals[stopKey], ts)
-						}
+					stopKey := pp.Route + ":" + dirStr + ":" + bestStop.StopID
+					dedupeKey := pp.VehicleID + ":" + stopKey
+					ts := pp.RecordedAt.UnixMilli()
+					last, exists := lastSeenAt[dedupeKey]
+					if !exists || ts-last >= 3*60*1000 {
+						lastSeenAt[dedupeKey] = ts
+						stopArrivals[stopKey] = append(stopArrivals[stopKey], ts)
 					}
 				}
-
-				totalPositions++
 			}
 
-			// Free memory immediately
-			body = nil
-			snap.Positions = nil
+			totalPositions++
 		}
 
 		// Write batch positions to staging table
-		if len(batchPositions) > 0 {
-			for i := 0; i < len(batchPositions); i += 1000 {
-				end := i + 1000
-				if end > len(batchPositions) {
-					end = len(batchPositions)
-				}
-				chunk := batchPositions[i:end]
-
-				query := `INSERT INTO "PositionStagingTemp" ("recordedAt", "vehicleId", "vehicleNum", route, "directionId", lat, lon, speed, "tripId") VALUES `
-				var args []interface{}
-				var placeholders []string
-				for j, p := range chunk {
-					base := j * 9
-					placeholders = append(placeholders, fmt.Sprintf("($%d,$%d,$%d,$%d,$%d,$%d,$%d,$%d,$%d)",
-						base+1, base+2, base+3, base+4, base+5, base+6, base+7, base+8, base+9))
-					args = append(args, p.RecordedAt, p.VehicleID, p.VehicleNum, p.Route, p.DirectionID, p.Lat, p.Lon, p.Speed, p.TripID)
-				}
-				query += strings.Join(placeholders, ",")
-				if _, err := pool.Exec(ctx, query, args...); err != nil {
-					return fmt.Errorf("insert positions batch: %w", err)
-				}
+		for i := 0; i < len(batchPositions); i += 1000 {
+			end := i + 1000
+			if end > len(batchPositions) {
+				end = len(batchPositions)
 			}
-		}
+			chunk := batchPositions[i:end]
 
-		log.Printf("[aggregate] Batch %d/%d: %d positions loaded", batchNum, (len(keys)+snapshotBatchSize-1)/snapshotBatchSize, len(batchPositions))
+			query := `INSERT INTO "PositionStagingTemp" ("recordedAt", "vehicleId", "vehicleNum", route, "directionId", lat, lon, speed, "tripId") VALUES `
+			var args []interface{}
+			var placeholders []string
+			for j, p := range chunk {
+				base := j * 9
+				placeholders = append(placeholders, fmt.Sprintf("($%d,$%d,$%d,$%d,$%d,$%d,$%d,$%d,$%d)",
+					base+1, base+2, base+3, base+4, base+5, base+6, base+7, base+8, base+9))
+				args = append(args, p.RecordedAt, p.VehicleID, p.VehicleNum, p.Route, p.DirectionID, p.Lat, p.Lon, p.Speed, p.TripID)
+			}
+			query += strings.Join(placeholders, ",")
+			if _, err := pool.Exec(ctx, query, args...); err != nil {
+				return fmt.Errorf("insert positions batch: %w", err)
+			}
+		}
 
-		// Clear batch positions to free memory
-		batchPositions = nil
+		logger(ctx).Debug("batch loaded", "batch", batchNum, "positions", len(batchPositions))
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	log.Printf("[aggregate] Processed %d positions from %d files in %d batches", totalPositions, len(keys), batchNum)
+	logger(ctx).Info("positions processed", "positions", totalPositions, "batches", batchNum)
 
 	// Trip reconstruction from staging table (stream by vehicle)
-	log.Printf("[aggregate] Reconstructing trips from staging table...")
+	logger(ctx).Info("reconstructing trips from staging table")
 
 	// Get all unique vehicles
 	vehicleRows, err := pool.Query(ctx, `SELECT DISTINCT "vehicleId" FROM "PositionStagingTemp" ORDER BY "vehicleId"`)
@@ -334,7 +353,7 @@ func runAggregateDailyIncremental(ctx context.Context, pool *pgxpool.Pool, r2 *s
 
 			processedVehicles++
 			if processedVehicles%100 == 0 {
-				log.Printf("[aggregate] Reconstructed trips for %d/%d vehicles", processedVehicles, len(vehicles))
+				logger(ctx).Debug("trip reconstruction progress", "vehicles", processedVehicles, "totalVehicles", len(vehicles))
 			}
 
 			// Free memory for this vehicle
@@ -342,7 +361,7 @@ func runAggregateDailyIncremental(ctx context.Context, pool *pgxpool.Pool, r2 *s
 		}
 	}
 
-	log.Printf("[aggregate] Reconstructed %d trips from %d vehicles", len(allTrips), len(vehicles))
+	logger(ctx).Info("trips reconstructed", "trips", len(allTrips), "vehicles", len(vehicles))
 
 	// Store trip logs
 	if len(allTrips) > 0 {
@@ -462,7 +481,7 @@ func runAggregateDailyIncremental(ctx context.Context, pool *pgxpool.Pool, r2 *s
 				return fmt.Errorf("insert segment speeds: %w", err)
 			}
 		}
-		log.Printf("[aggregate] Computed %d segment speed aggregates", len(segSpeedRows))
+		logger(ctx).Info("segment speeds computed", "rows", len(segSpeedRows))
 	}
 
 	// Route performance daily
@@ -577,7 +596,7 @@ func runAggregateDailyIncremental(ctx context.Context, pool *pgxpool.Pool, r2 *s
 			}
 		}
 	}
-	log.Printf("[aggregate] Computed performance for %d route-directions", len(routePerfRows))
+	logger(ctx).Info("route performance computed", "routeDirections", len(routePerfRows))
 
 	// Stop headway irregularity (from memory - small)
 	if len(stopArrivals) > 0 {
@@ -668,7 +687,7 @@ func runAggregateDailyIncremental(ctx context.Context, pool *pgxpool.Pool, r2 *s
 				return fmt.Errorf("insert stop headway: %w", err)
 			}
 		}
-		log.Printf("[aggregate] Computed headway irregularity for %d stops", len(headwayRows))
+		logger(ctx).Info("headway irregularity computed", "stops", len(headwayRows))
 	}
 
 	// Network summary
@@ -728,6 +747,6 @@ func runAggregateDailyIncremental(ctx context.Context, pool *pgxpool.Pool, r2 *s
 	}
 
 	elapsed := time.Since(startTime)
-	log.Printf("[aggregate] Complete for %s: %d positions, %d trips in %s", dateStr, totalPositions, len(allTrips), elapsed)
+	logger(ctx).Info("aggregate complete", "date", dateStr, "positions", totalPositions, "trips", len(allTrips), "duration", elapsed)
 	return nil
 }
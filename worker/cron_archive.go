@@ -1,225 +1,297 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
-	"io"
-	"log"
-	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/credentials"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/parquet-go/parquet-go"
 )
 
-// ParquetPosition is the schema for the Parquet file
+// parquetSchemaVersion is recorded in each archive's file metadata
+// ("schema_version") and R2 object metadata. Version 1 files (no key) store
+// recorded_at as an RFC 3339 string and use "" / -1 for missing values;
+// version 2 uses a TIMESTAMP column and nullable columns instead, but its
+// recorded_at is the source's observation time where it reported one.
+// Version 3 keeps recorded_at as the snapshot (cycle) time, as in version 1,
+// and adds observed_at for the source's time (null if it reported none).
+const parquetSchemaVersion = "3"
+
+// ParquetPosition is the schema for the Parquet file (schema version 3)
 type ParquetPosition struct {
-	RecordedAt  string  `parquet:"recorded_at"`
-	VehicleID   string  `parquet:"vehicle_id"`
-	VehicleNum  string  `parquet:"vehicle_num"`
-	Route       string  `parquet:"route"`
-	TripID      string  `parquet:"trip_id"`
-	DirectionID int32   `parquet:"direction_id"`
-	Lat         float64 `parquet:"lat"`
-	Lon         float64 `parquet:"lon"`
-	Speed       float32 `parquet:"speed"`
-	Heading     float32 `parquet:"heading"`
+	RecordedAt  time.Time  `parquet:"recorded_at,timestamp(millisecond)"`
+	ObservedAt  *time.Time `parquet:"observed_at,optional"`
+	VehicleID   string     `parquet:"vehicle_id"`
+	VehicleNum  *string    `parquet:"vehicle_num,optional"`
+	Route       *string    `parquet:"route,optional"`
+	TripID      *string    `parquet:"trip_id,optional"`
+	DirectionID *int32     `parquet:"direction_id,optional"`
+	Lat         float64    `parquet:"lat"`
+	Lon         float64    `parquet:"lon"`
+	Speed       *float32   `parquet:"speed,optional"`
+	Heading     *float32   `parquet:"heading,optional"`
+	Stale       bool       `parquet:"stale"`
+	Duplicate   bool       `parquet:"duplicate"`
 }
 
-func getR2Client() (*s3.Client, string) {
-	endpoint := os.Getenv("R2_ENDPOINT")
-	accessKeyID := os.Getenv("R2_ACCESS_KEY_ID")
-	secretAccessKey := os.Getenv("R2_SECRET_ACCESS_KEY")
-
-	if endpoint == "" || accessKeyID == "" || secretAccessKey == "" {
-		return nil, ""
+// newParquetPosition converts a snapshot position recorded in the cycle at
+// recordedAt.
+func newParquetPosition(p *SnapshotPosition, recordedAt time.Time) ParquetPosition {
+	row := ParquetPosition{
+		RecordedAt: recordedAt.UTC(),
+		VehicleID:  p.VehicleID,
+		Lat:        p.Lat,
+		Lon:        p.Lon,
+		Speed:      p.Speed,
+		Heading:    p.Heading,
+		Stale:      p.Stale,
+		Duplicate:  p.Duplicate,
+	}
+	if p.VehicleNum != "" {
+		v := p.VehicleNum
+		row.VehicleNum = &v
+	}
+	if p.Route != "" {
+		r := p.Route
+		row.Route = &r
+	}
+	if p.TripID != "" {
+		t := p.TripID
+		row.TripID = &t
+	}
+	if p.DirectionID != nil {
+		d := int32(*p.DirectionID)
+		row.DirectionID = &d
 	}
+	if p.ObservedAt != "" {
+		if t, err := time.Parse(time.RFC3339, p.ObservedAt); err == nil {
+			t = t.UTC()
+			row.ObservedAt = &t
+		}
+	}
+	return row
+}
+
+// archiveRowGroupSnapshots is how many snapshot cycles go into one Parquet row
+// group: an hour of 30-second cycles. Only one row group is held in memory.
+const archiveRowGroupSnapshots = 120
+
+// archiveWriter streams ParquetPosition row groups to the store (on R2, a
+// multipart upload), so peak memory is one row group plus one upload part.
+type archiveWriter struct {
+	upload objectWriter
+	writer *parquet.GenericWriter[ParquetPosition]
+	rows   int
+}
 
-	bucket := os.Getenv("R2_BUCKET")
-	if bucket == "" {
-		bucket = "porto-move"
+func newArchiveWriter(ctx context.Context, store objectStore, key string) (*archiveWriter, error) {
+	upload, err := store.NewWriter(ctx, key, "application/vnd.apache.parquet")
+	if err != nil {
+		return nil, err
 	}
+	writer := parquet.NewGenericWriter[ParquetPosition](upload,
+		parquet.KeyValueMetadata("schema_version", parquetSchemaVersion))
+	return &archiveWriter{upload: upload, writer: writer}, nil
+}
 
-	client := s3.New(s3.Options{
-		BaseEndpoint: &endpoint,
-		Region:       "auto",
-		Credentials:  credentials.NewStaticCredentialsProvider(accessKeyID, secretAccessKey, ""),
+// WriteRowGroup sorts rows by vehicle and time (which compresses far better
+// than snapshot order) and writes them as one row group.
+func (w *archiveWriter) WriteRowGroup(rows []ParquetPosition) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].VehicleID != rows[j].VehicleID {
+			return rows[i].VehicleID < rows[j].VehicleID
+		}
+		return rows[i].RecordedAt.Before(rows[j].RecordedAt)
 	})
+	if _, err := w.writer.Write(rows); err != nil {
+		return fmt.Errorf("write parquet rows: %w", err)
+	}
+	if err := w.writer.Flush(); err != nil {
+		return fmt.Errorf("flush parquet row group: %w", err)
+	}
+	w.rows += len(rows)
+	return nil
+}
 
-	return client, bucket
+// Close writes the Parquet footer and completes the upload; the row count is
+// added to metadata automatically.
+func (w *archiveWriter) Close(metadata map[string]string) error {
+	w.writer.SetKeyValueMetadata("rows", strconv.Itoa(w.rows))
+	if err := w.writer.Close(); err != nil {
+		w.upload.Abort()
+		return fmt.Errorf("close parquet writer: %w", err)
+	}
+	metadata["rows"] = strconv.Itoa(w.rows)
+	metadata["schema_version"] = parquetSchemaVersion
+	// A failed Complete has already discarded the upload.
+	return w.upload.Complete(metadata)
 }
 
-// runArchivePositions reads yesterday's R2 snapshot files and writes a single
-// Parquet archive to positions/YYYY/MM/DD.parquet. No database access needed.
-func runArchivePositions(ctx context.Context, r2 *s3.Client, bucket string) error {
+// Abort discards a partially written archive.
+func (w *archiveWriter) Abort() { w.upload.Abort() }
+
+// runArchivePositions writes yesterday's positions (or date's, if non-zero)
+// to a single Parquet archive at positions/YYYY/MM/DD.parquet. Hours already
+// archived by archive-hourly are compacted from their partitions; any other
+// hour, or one whose snapshots outnumber its partition's (late spool uploads
+// or batches), is streamed from its snapshot files. An existing archive is
+// left alone unless rearchive is set, in which case it is rebuilt and
+// replaced (e.g. after snapshots arrived late). No database access needed.
+func runArchivePositions(ctx context.Context, store objectStore, date time.Time, rearchive bool) error {
 	startTime := time.Now()
 
 	now := time.Now().UTC()
 	yesterday := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, time.UTC)
+	if !date.IsZero() {
+		yesterday = time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	}
 	dateStr := yesterday.Format("2006-01-02")
 
 	key := fmt.Sprintf("positions/%04d/%02d/%02d.parquet",
 		yesterday.Year(), yesterday.Month(), yesterday.Day())
 
 	// Check if already archived (idempotent)
-	_, err := r2.HeadObject(ctx, &s3.HeadObjectInput{
-		Bucket: &bucket,
-		Key:    &key,
-	})
-	if err == nil {
-		log.Printf("[archive] %s already exists — skipping", key)
+	if _, err := store.Head(ctx, key); err == nil && !rearchive {
+		logger(ctx).Info("archive already exists, skipping", "key", key)
 		return nil
 	}
 
-	// List snapshot files for yesterday from R2
-	keys, err := listSnapshotKeys(ctx, r2, bucket, dateStr)
+	// List snapshot files and hourly partitions for yesterday
+	keys, err := listSnapshotKeys(ctx, store, dateStr)
 	if err != nil {
 		return fmt.Errorf("list snapshots: %w", err)
 	}
-	if len(keys) == 0 {
-		log.Printf("[archive] No snapshots for %s", dateStr)
+	partitions, err := store.List(ctx, "positions/date="+dateStr+"/")
+	if err != nil {
+		return fmt.Errorf("list hourly partitions: %w", err)
+	}
+	if len(keys) == 0 && len(partitions) == 0 {
+		logger(ctx).Info("no snapshots to archive", "date", dateStr)
 		return nil
 	}
-	log.Printf("[archive] Reading %d snapshot files for %s", len(keys), dateStr)
-
-	// Read all snapshots and convert to Parquet rows
-	var rows []ParquetPosition
-	for _, snapKey := range keys {
-		out, err := r2.GetObject(ctx, &s3.GetObjectInput{Bucket: &bucket, Key: &snapKey})
-		if err != nil {
-			log.Printf("[archive] WARNING: failed to fetch %s: %v", snapKey, err)
-			continue
-		}
-		body, err := io.ReadAll(out.Body)
-		out.Body.Close()
-		if err != nil {
-			log.Printf("[archive] WARNING: failed to read %s: %v", snapKey, err)
-			continue
-		}
-		var snap SnapshotFile
-		if err := json.Unmarshal(body, &snap); err != nil {
-			log.Printf("[archive] WARNING: failed to parse %s: %v", snapKey, err)
-			continue
+	hasPartition := make(map[string]bool, len(partitions))
+	for _, p := range partitions {
+		hasPartition[p] = true
+	}
+	keysByHour := make(map[int][]string)
+	for _, k := range keys {
+		if h, ok := snapshotKeyHour(k); ok {
+			keysByHour[h] = append(keysByHour[h], k)
 		}
-		for _, p := range snap.Positions {
-			row := ParquetPosition{
-				RecordedAt: snap.RecordedAt,
-				VehicleID:  p.VehicleID,
-				VehicleNum: p.VehicleNum,
-				Route:      p.Route,
-				TripID:     p.TripID,
-				Lat:        p.Lat,
-				Lon:        p.Lon,
-			}
-			if p.DirectionID != nil {
-				row.DirectionID = int32(*p.DirectionID)
-			} else {
-				row.DirectionID = -1
-			}
-			if p.Speed != nil {
-				row.Speed = float32(*p.Speed)
+	}
+	logger(ctx).Info("compacting daily archive", "date", dateStr, "partitions", len(partitions), "files", len(keys), "key", key)
+
+	aw, err := newArchiveWriter(ctx, store, key)
+	if err != nil {
+		return err
+	}
+
+	snapshotsArchived := 0
+	for h := 0; h < 24; h++ {
+		partKey := hourlyPartitionKey(yesterday, h)
+		if hasPartition[partKey] {
+			if n, err := copyPartition(ctx, store, partKey, len(keysByHour[h]), aw); err == nil {
+				snapshotsArchived += n
+				continue
 			} else {
-				row.Speed = -1
+				logger(ctx).Warn("hourly partition not usable, rebuilding from snapshots", "key", partKey, "hour", h, "error", err)
 			}
-			// Heading not available in snapshots
-			row.Heading = -1
-			rows = append(rows, row)
 		}
+		n, err := archiveSnapshots(ctx, store, keysByHour[h], aw)
+		if err != nil {
+			aw.Abort()
+			return err
+		}
+		snapshotsArchived += n
 	}
 
-	if len(rows) == 0 {
-		log.Printf("[archive] No positions in snapshots for %s", dateStr)
+	if aw.rows == 0 {
+		aw.Abort()
+		logger(ctx).Info("no positions in snapshots", "date", dateStr)
 		return nil
 	}
 
-	log.Printf("[archive] Writing %d positions to %s", len(rows), key)
-
-	// Write Parquet to buffer
-	var buf bytes.Buffer
-	writer := parquet.NewGenericWriter[ParquetPosition](&buf)
-	if _, err := writer.Write(rows); err != nil {
-		return fmt.Errorf("write parquet rows: %w", err)
-	}
-	if err := writer.Close(); err != nil {
-		return fmt.Errorf("close parquet writer: %w", err)
-	}
-
-	// Upload to R2
-	body := buf.Bytes()
-	contentType := "application/vnd.apache.parquet"
-	_, err = r2.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:      &bucket,
-		Key:         &key,
-		Body:        bytes.NewReader(body),
-		ContentType: &contentType,
-		Metadata: map[string]string{
-			"rows": fmt.Sprintf("%d", len(rows)),
-			"date": dateStr,
-		},
-	})
-	if err != nil {
-		return fmt.Errorf("upload to R2: %w", err)
+	// "snapshots" lets cleanup check that every snapshot file made it in.
+	if err := aw.Close(map[string]string{
+		"date":      dateStr,
+		"snapshots": strconv.Itoa(snapshotsArchived),
+	}); err != nil {
+		return fmt.Errorf("upload archive: %w", err)
 	}
 
-	// Free rows memory
-	rows = nil
-	_ = rows
-
 	elapsed := time.Since(startTime)
-	sizeMB := float64(len(body)) / 1024 / 1024
-	log.Printf("[archive] Archived %d positions (%.2f MB) to %s in %s",
-		len(body), sizeMB, key, elapsed)
+	logger(ctx).Info("archive complete", "date", dateStr, "positions", aw.rows, "bytes", aw.upload.Size(), "key", key, "duration", elapsed)
 	return nil
 }
 
-// listSnapshotKeysForCleanup returns snapshot object keys older than the cutoff.
-// It lists all snapshots/ prefixed objects and filters by date directory.
-func listSnapshotKeysForCleanup(ctx context.Context, r2 *s3.Client, bucket string, beforeDate time.Time) ([]string, error) {
-	prefix := "snapshots/"
-	var keys []string
-	var continuationToken *string
-
-	for {
-		out, err := r2.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
-			Bucket:            &bucket,
-			Prefix:            &prefix,
-			ContinuationToken: continuationToken,
-		})
+// archiveSnapshots streams snapshot files (in key, i.e. time, order) into aw,
+// one row group per archiveRowGroupSnapshots cycles, and returns how many
+// files were read.
+func archiveSnapshots(ctx context.Context, store objectStore, keys []string, aw *archiveWriter) (int, error) {
+	var group []ParquetPosition
+	read, cycles := 0, 0
+	for _, snapKey := range keys {
+		snaps, err := readSnapshots(ctx, store, snapKey)
 		if err != nil {
-			return nil, fmt.Errorf("list R2 objects: %w", err)
+			logger(ctx).Warn("failed to read snapshot", "key", snapKey, "error", err)
+			continue
 		}
-		for _, obj := range out.Contents {
-			if obj.Key == nil {
-				continue
-			}
-			k := *obj.Key
-			// Skip today.json
-			if k == "snapshots/today.json" {
-				continue
-			}
-			// Keys look like snapshots/YYYY/MM/DD/HHMMSS.json
-			// Extract date from path
-			parts := strings.Split(strings.TrimPrefix(k, "snapshots/"), "/")
-			if len(parts) < 3 {
-				continue
-			}
-			dateStr := parts[0] + "-" + parts[1] + "-" + parts[2]
-			t, err := time.Parse("2006-01-02", dateStr)
+		for _, snap := range snaps {
+			recordedAt, err := time.Parse(time.RFC3339, snap.RecordedAt)
 			if err != nil {
+				logger(ctx).Warn("bad recordedAt in snapshot", "key", snapKey, "error", err)
 				continue
 			}
-			if t.Before(beforeDate) {
-				keys = append(keys, k)
+			for j := range snap.Positions {
+				group = append(group, newParquetPosition(&snap.Positions[j], recordedAt))
 			}
+			cycles++
+
+			if cycles%archiveRowGroupSnapshots == 0 {
+				if err := aw.WriteRowGroup(group); err != nil {
+					return read, err
+				}
+				group = group[:0]
+			}
+		}
+		read++
+	}
+	return read, aw.WriteRowGroup(group)
+}
+
+// listSnapshotKeysForCleanup returns snapshot object keys older than the cutoff.
+// It lists all snapshots/ prefixed objects and filters by date directory.
+func listSnapshotKeysForCleanup(ctx context.Context, store objectStore, beforeDate time.Time) ([]string, error) {
+	all, err := store.List(ctx, "snapshots/")
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, k := range all {
+		// Skip today.json
+		if k == "snapshots/today.json" {
+			continue
+		}
+		// Keys look like snapshots/YYYY/MM/DD/HHMMSS.json (or HHMM.ndjson)
+		// Extract date from path
+		parts := strings.Split(strings.TrimPrefix(k, "snapshots/"), "/")
+		if len(parts) < 3 {
+			continue
+		}
+		dateStr := parts[0] + "-" + parts[1] + "-" + parts[2]
+		t, err := time.Parse("2006-01-02", dateStr)
+		if err != nil {
+			continue
 		}
-		if out.IsTruncated == nil || !*out.IsTruncated {
-			break
+		if t.Before(beforeDate) {
+			keys = append(keys, k)
 		}
-		continuationToken = out.NextContinuationToken
 	}
 	return keys, nil
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// hourlyPartitionKey is the Hive-style key of one hour's archive, so DuckDB
+// and Spark can prune on date/hour:
+// positions/date=YYYY-MM-DD/hour=HH/part-0.parquet
+func hourlyPartitionKey(day time.Time, hour int) string {
+	return fmt.Sprintf("positions/date=%s/hour=%02d/part-0.parquet", day.Format("2006-01-02"), hour)
+}
+
+// snapshotKeyHour extracts the UTC hour from snapshots/YYYY/MM/DD/HHMMSS.json
+// or a batch's HHMM.ndjson.
+func snapshotKeyHour(key string) (int, bool) {
+	base := path.Base(key)
+	if len(base) < 2 {
+		return 0, false
+	}
+	h, err := strconv.Atoi(base[:2])
+	if err != nil || h < 0 || h > 23 {
+		return 0, false
+	}
+	return h, true
+}
+
+// runArchiveHourly archives the previous full UTC hour of snapshots to its
+// hourly partition, so same-day history is queryable within the hour instead
+// of after the 03:00 daily archive. A non-zero date archives every completed
+// hour of that day instead.
+func runArchiveHourly(ctx context.Context, store objectStore, date time.Time) error {
+	lastHour := time.Now().UTC().Truncate(time.Hour).Add(-time.Hour)
+	if date.IsZero() {
+		return archiveHour(ctx, store, lastHour)
+	}
+	day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	for h := 0; h < 24; h++ {
+		hourStart := day.Add(time.Duration(h) * time.Hour)
+		if hourStart.After(lastHour) {
+			break
+		}
+		if err := archiveHour(ctx, store, hourStart); err != nil {
+			return fmt.Errorf("hour %02d: %w", h, err)
+		}
+	}
+	return nil
+}
+
+// archiveHour archives the snapshots of the UTC hour starting at hourStart.
+func archiveHour(ctx context.Context, store objectStore, hourStart time.Time) error {
+	startTime := time.Now()
+
+	day := time.Date(hourStart.Year(), hourStart.Month(), hourStart.Day(), 0, 0, 0, 0, time.UTC)
+	key := hourlyPartitionKey(day, hourStart.Hour())
+
+	// Check if already archived (idempotent)
+	if _, err := store.Head(ctx, key); err == nil {
+		logger(ctx).Info("partition already exists, skipping", "key", key)
+		return nil
+	}
+
+	prefix := fmt.Sprintf("snapshots/%04d/%02d/%02d/%02d",
+		hourStart.Year(), hourStart.Month(), hourStart.Day(), hourStart.Hour())
+	keys, err := store.List(ctx, prefix)
+	if err != nil {
+		return fmt.Errorf("list snapshots: %w", err)
+	}
+	if len(keys) == 0 {
+		logger(ctx).Info("no snapshots to archive", "hour", hourStart.Format("2006-01-02 15:00"))
+		return nil
+	}
+
+	aw, err := newArchiveWriter(ctx, store, key)
+	if err != nil {
+		return err
+	}
+	read, err := archiveSnapshots(ctx, store, keys, aw)
+	if err != nil {
+		aw.Abort()
+		return err
+	}
+	if aw.rows == 0 {
+		aw.Abort()
+		logger(ctx).Info("no positions in snapshots", "hour", hourStart.Format("2006-01-02 15:00"))
+		return nil
+	}
+	if err := aw.Close(map[string]string{
+		"date":      day.Format("2006-01-02"),
+		"hour":      fmt.Sprintf("%02d", hourStart.Hour()),
+		"snapshots": strconv.Itoa(read),
+	}); err != nil {
+		return fmt.Errorf("upload partition: %w", err)
+	}
+
+	logger(ctx).Info("hourly partition complete", "hour", hourStart.Format("2006-01-02 15:00"),
+		"positions", aw.rows, "files", len(keys), "key", key, "duration", time.Since(startTime))
+	return nil
+}
+
+// copyPartition appends an hourly partition's rows to aw as one row group and
+// returns the number of snapshots the partition was built from. It fails
+// without writing anything if the partition covers fewer than want snapshot
+// files (some landed after the hour was archived, e.g. from the spool) or, with
+// want > 0, predates the "snapshots" metadata, so the caller can rebuild the
+// hour. Partitions are an hour of positions (a few MB), so they are read whole.
+func copyPartition(ctx context.Context, store objectStore, key string, want int, aw *archiveWriter) (int, error) {
+	rc, info, err := store.Get(ctx, key)
+	if err != nil {
+		return 0, fmt.Errorf("fetch: %w", err)
+	}
+	defer rc.Close()
+	snapshots, err := strconv.Atoi(info.Metadata["snapshots"])
+	switch {
+	case err != nil && want > 0:
+		return 0, fmt.Errorf("no snapshot count to check against %d snapshot files", want)
+	case err != nil:
+		snapshots = 0
+	case snapshots < want:
+		return 0, fmt.Errorf("covers %d of %d snapshot files", snapshots, want)
+	}
+	body, err := io.ReadAll(rc)
+	if err != nil {
+		return 0, fmt.Errorf("read: %w", err)
+	}
+
+	file, err := parquet.OpenFile(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return 0, fmt.Errorf("open parquet: %w", err)
+	}
+	if v, _ := file.Lookup("schema_version"); v != parquetSchemaVersion {
+		return 0, fmt.Errorf("schema version %q, want %s", v, parquetSchemaVersion)
+	}
+
+	reader := parquet.NewGenericReader[ParquetPosition](file)
+	defer reader.Close()
+	rows := make([]ParquetPosition, 0, file.NumRows())
+	buf := make([]ParquetPosition, 1024)
+	for {
+		n, err := reader.Read(buf)
+		rows = append(rows, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("read rows: %w", err)
+		}
+	}
+	return snapshots, aw.WriteRowGroup(rows)
+}
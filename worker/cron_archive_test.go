@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// readArchive returns the rows of the Parquet object at key.
+func readArchive(t *testing.T, store objectStore, key string) []ParquetPosition {
+	t.Helper()
+	rc, _, err := store.Get(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := parquet.Read[ParquetPosition](bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestArchiveKeepsSnapshotAndObservedTimes(t *testing.T) {
+	ctx := context.Background()
+	store := newTestLocalStore(t)
+	day := time.Date(2025, 1, 30, 0, 0, 0, 0, time.UTC)
+	recordedAt := day.Add(10 * time.Hour)
+	observedAt := recordedAt.Add(-20 * time.Second)
+
+	snap := SnapshotFile{RecordedAt: recordedAt.Format(time.RFC3339), Positions: []SnapshotPosition{
+		{VehicleID: "a", Route: "205", Lat: 41.1, Lon: -8.6, ObservedAt: observedAt.Format(time.RFC3339Nano)},
+		{VehicleID: "b", Route: "205", Lat: 41.2, Lon: -8.6},
+	}}
+	body, _ := json.Marshal(snap)
+	if err := store.Put(ctx, fmt.Sprintf("snapshots/%s.json", recordedAt.Format("2006/01/02/150405")), body, putOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runArchivePositions(ctx, store, day, false); err != nil {
+		t.Fatal(err)
+	}
+
+	rows := readArchive(t, store, "positions/2025/01/30.parquet")
+	if len(rows) != 2 {
+		t.Fatalf("got %d rows, want 2", len(rows))
+	}
+	for _, r := range rows {
+		if !r.RecordedAt.Equal(recordedAt) {
+			t.Errorf("%s: recorded_at %v, want the snapshot time %v", r.VehicleID, r.RecordedAt, recordedAt)
+		}
+	}
+	if rows[0].ObservedAt == nil || !rows[0].ObservedAt.Equal(observedAt) || rows[1].ObservedAt != nil {
+		t.Errorf("observed_at = %v, %v; want %v and null", rows[0].ObservedAt, rows[1].ObservedAt, observedAt)
+	}
+
+	// Backfill times positions by observation, like aggregation from snapshots.
+	var points []PositionPoint
+	in := &parquetInput{store: store, key: "positions/2025/01/30.parquet"}
+	if err := in.Batches(ctx, func(batch []PositionPoint) error {
+		points = append(points, batch...)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 2 || !points[0].RecordedAt.Equal(observedAt) || !points[1].RecordedAt.Equal(recordedAt) {
+		t.Errorf("backfill points = %+v", points)
+	}
+}
+
+func TestArchiveCompactsHourlyPartitions(t *testing.T) {
+	ctx := context.Background()
+	store := newTestLocalStore(t)
+	day := time.Date(2025, 1, 30, 0, 0, 0, 0, time.UTC)
+	putTestSnapshot(t, store, day.Add(10*time.Hour), "a", "b")
+	putTestSnapshot(t, store, day.Add(10*time.Hour+15*time.Minute), "a")
+	putTestSnapshot(t, store, day.Add(11*time.Hour), "a")
+	for _, h := range []int{10, 11} {
+		if err := archiveHour(ctx, store, day.Add(time.Duration(h)*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Hour 10 gains a snapshot from the spool after it was archived, so its
+	// partition covers fewer files and is rebuilt. Hour 11's partition is
+	// complete and copied as is, so changing its snapshot afterwards does
+	// not show.
+	putTestSnapshot(t, store, day.Add(10*time.Hour+30*time.Minute), "late")
+	putTestSnapshot(t, store, day.Add(11*time.Hour), "changed")
+
+	if err := runArchivePositions(ctx, store, day, false); err != nil {
+		t.Fatal(err)
+	}
+	const key = "positions/2025/01/30.parquet"
+	var vehicles []string
+	for _, r := range readArchive(t, store, key) {
+		vehicles = append(vehicles, r.VehicleID)
+	}
+	sort.Strings(vehicles)
+	if want := []string{"a", "a", "a", "b", "late"}; !reflect.DeepEqual(vehicles, want) {
+		t.Errorf("archived vehicles %q, want %q", vehicles, want)
+	}
+	if head, err := store.Head(ctx, key); err != nil || head.Metadata["snapshots"] != "4" {
+		t.Errorf("archive metadata = %v, %v; want 4 snapshots", head.Metadata, err)
+	}
+	if err := verifyArchive(ctx, store, "2025-01-30", listKeys(t, store, "snapshots/2025/01/30/")); err != nil {
+		t.Errorf("verifyArchive: %v", err)
+	}
+}
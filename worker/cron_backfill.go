@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/parquet-go/parquet-go"
+)
+
+// backfillProgressKey records which dates a backfill has finished, so an
+// interrupted run resumes where it stopped.
+const backfillProgressKey = "backfill/progress.json"
+
+// parquetBatchSize is the number of positions handed to aggregateDay per
+// batch when reading an archive.
+const parquetBatchSize = 50000
+
+// parquetPositionV1 is the schema of archives written before schema version 2.
+type parquetPositionV1 struct {
+	RecordedAt  string  `parquet:"recorded_at"`
+	VehicleID   string  `parquet:"vehicle_id"`
+	VehicleNum  string  `parquet:"vehicle_num"`
+	Route       string  `parquet:"route"`
+	TripID      string  `parquet:"trip_id"`
+	DirectionID int32   `parquet:"direction_id"`
+	Lat         float64 `parquet:"lat"`
+	Lon         float64 `parquet:"lon"`
+	Speed       float32 `parquet:"speed"`
+	Heading     float32 `parquet:"heading"`
+}
+
+// parquetPositionV2 is the schema of version 2 archives, whose recorded_at
+// already holds the observation time where the source reported one.
+type parquetPositionV2 struct {
+	RecordedAt  time.Time `parquet:"recorded_at,timestamp(millisecond)"`
+	VehicleID   string    `parquet:"vehicle_id"`
+	VehicleNum  *string   `parquet:"vehicle_num,optional"`
+	Route       *string   `parquet:"route,optional"`
+	TripID      *string   `parquet:"trip_id,optional"`
+	DirectionID *int32    `parquet:"direction_id,optional"`
+	Lat         float64   `parquet:"lat"`
+	Lon         float64   `parquet:"lon"`
+	Speed       *float32  `parquet:"speed,optional"`
+	Heading     *float32  `parquet:"heading,optional"`
+	Stale       bool      `parquet:"stale"`
+	Duplicate   bool      `parquet:"duplicate"`
+}
+
+// positionPoint converts an archive row, reporting false for rows the
+// aggregation skips. Like aggregation from snapshots, it times a position by
+// its observation when the source reported one.
+func (r *ParquetPosition) positionPoint() (PositionPoint, bool) {
+	at := r.RecordedAt
+	if r.ObservedAt != nil {
+		at = *r.ObservedAt
+	}
+	return (&parquetPositionV2{
+		RecordedAt: at, VehicleID: r.VehicleID, VehicleNum: r.VehicleNum, Route: r.Route,
+		TripID: r.TripID, DirectionID: r.DirectionID, Lat: r.Lat, Lon: r.Lon,
+		Speed: r.Speed, Heading: r.Heading, Stale: r.Stale, Duplicate: r.Duplicate,
+	}).positionPoint()
+}
+
+// positionPoint converts a v2 archive row, reporting false for rows the
+// aggregation skips.
+func (r *parquetPositionV2) positionPoint() (PositionPoint, bool) {
+	if r.Route == nil || *r.Route == "" || r.Stale || r.Duplicate {
+		return PositionPoint{}, false
+	}
+	pp := PositionPoint{
+		RecordedAt: r.RecordedAt.UTC(),
+		VehicleID:  r.VehicleID,
+		VehicleNum: r.VehicleNum,
+		Route:      *r.Route,
+		TripID:     r.TripID,
+		Lat:        r.Lat,
+		Lon:        r.Lon,
+		Speed:      r.Speed,
+	}
+	if r.DirectionID != nil {
+		d := int16(*r.DirectionID)
+		pp.DirectionID = &d
+	}
+	return pp, true
+}
+
+// positionPoint converts a v1 archive row, mapping its "" / -1 sentinels to nil.
+func (r *parquetPositionV1) positionPoint() (PositionPoint, bool) {
+	if r.Route == "" {
+		return PositionPoint{}, false
+	}
+	recordedAt, err := time.Parse(time.RFC3339, r.RecordedAt)
+	if err != nil {
+		return PositionPoint{}, false
+	}
+	pp := PositionPoint{
+		RecordedAt: recordedAt.UTC(),
+		VehicleID:  r.VehicleID,
+		Route:      r.Route,
+		Lat:        r.Lat,
+		Lon:        r.Lon,
+	}
+	if r.VehicleNum != "" {
+		pp.VehicleNum = &r.VehicleNum
+	}
+	if r.TripID != "" {
+		pp.TripID = &r.TripID
+	}
+	if r.DirectionID >= 0 {
+		d := int16(r.DirectionID)
+		pp.DirectionID = &d
+	}
+	if r.Speed >= 0 {
+		pp.Speed = &r.Speed
+	}
+	return pp, true
+}
+
+// parquetInput reads a daily positions/YYYY/MM/DD.parquet archive. The file
+// is spooled to a temp file rather than held in memory.
+type parquetInput struct {
+	store objectStore
+	key   string
+}
+
+func (in *parquetInput) Describe() string { return in.key }
+
+func (in *parquetInput) Batches(ctx context.Context, fn func(batch []PositionPoint) error) error {
+	body, _, err := in.store.Get(ctx, in.key)
+	if err != nil {
+		return fmt.Errorf("fetch %s: %w", in.key, err)
+	}
+	defer body.Close()
+
+	tmp, err := os.CreateTemp("", "backfill-*.parquet")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, body)
+	if err != nil {
+		return fmt.Errorf("download %s: %w", in.key, err)
+	}
+
+	file, err := parquet.OpenFile(tmp, size)
+	if err != nil {
+		return fmt.Errorf("open parquet: %w", err)
+	}
+
+	switch v, _ := file.Lookup("schema_version"); v {
+	case parquetSchemaVersion:
+		return readParquetBatches[ParquetPosition](file, fn)
+	case "2":
+		return readParquetBatches[parquetPositionV2](file, fn)
+	case "", "1":
+		return readParquetBatches[parquetPositionV1](file, fn)
+	default:
+		return fmt.Errorf("unsupported schema version %q in %s", v, in.key)
+	}
+}
+
+// readParquetBatches reads every row of file as T and passes the converted
+// positions to fn, parquetBatchSize at a time.
+func readParquetBatches[T any, PT interface {
+	*T
+	positionPoint() (PositionPoint, bool)
+}](file *parquet.File, fn func(batch []PositionPoint) error) error {
+	reader := parquet.NewGenericReader[T](file)
+	defer reader.Close()
+
+	buf := make([]T, 1024)
+	batch := make([]PositionPoint, 0, parquetBatchSize)
+	for {
+		n, err := reader.Read(buf)
+		for i := 0; i < n; i++ {
+			if pp, ok := PT(&buf[i]).positionPoint(); ok {
+				batch = append(batch, pp)
+			}
+		}
+		if len(batch) >= parquetBatchSize || (err == io.EOF && len(batch) > 0) {
+			if err := fn(batch); err != nil {
+				return err
+			}
+			batch = make([]PositionPoint, 0, parquetBatchSize)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read rows: %w", err)
+		}
+	}
+}
+
+// backfillProgress is the JSON document stored at backfillProgressKey.
+type backfillProgress struct {
+	Completed map[string]string `json:"completed"` // date -> finished at (RFC 3339)
+}
+
+func loadBackfillProgress(ctx context.Context, store objectStore) (*backfillProgress, error) {
+	progress := &backfillProgress{Completed: make(map[string]string)}
+	key := backfillProgressKey
+	body, _, err := store.Get(ctx, key)
+	if err != nil {
+		if errors.Is(err, errObjectNotFound) {
+			return progress, nil
+		}
+		return nil, err
+	}
+	defer body.Close()
+	if err := json.NewDecoder(body).Decode(progress); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", key, err)
+	}
+	if progress.Completed == nil {
+		progress.Completed = make(map[string]string)
+	}
+	return progress, nil
+}
+
+func (p *backfillProgress) save(ctx context.Context, store objectStore) error {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return store.Put(ctx, backfillProgressKey, body, putOptions{ContentType: "application/json"})
+}
+
+// runBackfill regenerates the daily aggregates for every date from..to
+// (inclusive) from the Parquet archives. Dates already recorded in
+// backfillProgressKey are skipped unless force is set; dates without an
+// archive are skipped with a warning.
+func runBackfill(ctx context.Context, pool *pgxpool.Pool, store objectStore, from, to time.Time, force bool) error {
+	from = time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)
+	to = time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, time.UTC)
+	if to.Before(from) {
+		return fmt.Errorf("--to %s is before --from %s", to.Format("2006-01-02"), from.Format("2006-01-02"))
+	}
+
+	progress, err := loadBackfillProgress(ctx, store)
+	if err != nil {
+		return fmt.Errorf("load progress: %w", err)
+	}
+
+	var done, skipped, missing []string
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		dateStr := day.Format("2006-01-02")
+		if _, ok := progress.Completed[dateStr]; ok && !force {
+			skipped = append(skipped, dateStr)
+			continue
+		}
+
+		key := fmt.Sprintf("positions/%s.parquet", day.Format("2006/01/02"))
+		if _, err := store.Head(ctx, key); err != nil {
+			logger(ctx).Warn("no archive for date", "date", dateStr, "key", key, "error", err)
+			missing = append(missing, dateStr)
+			continue
+		}
+
+		if err := aggregateDay(ctx, pool, day, &parquetInput{store: store, key: key}); err != nil {
+			return fmt.Errorf("backfill %s: %w", dateStr, err)
+		}
+
+		progress.Completed[dateStr] = time.Now().UTC().Format(time.RFC3339)
+		if err := progress.save(ctx, store); err != nil {
+			return fmt.Errorf("save progress: %w", err)
+		}
+		done = append(done, dateStr)
+	}
+
+	logger(ctx).Info("backfill complete", "rebuilt", len(done), "alreadyComplete", len(skipped), "missing", len(missing))
+	if len(missing) > 0 {
+		logger(ctx).Warn("missing archives", "dates", missing)
+	}
+	return nil
+}
@@ -3,49 +3,169 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
-
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
-// runCleanupPositions deletes R2 snapshot objects older than 2 days.
-// The Parquet archive (positions/YYYY/MM/DD.parquet) is kept permanently.
-func runCleanupPositions(ctx context.Context, r2 *s3.Client, bucket string) error {
+// runCleanupPositions deletes snapshot objects older than 2 days, or only
+// those of date if non-zero. Each date's snapshots are only deleted once its
+// Parquet archive (positions/YYYY/MM/DD.parquet, kept permanently) is verified
+// to cover them; unverified dates are kept and reported as an error. With
+// sweepOlder, a date's cleanup also retries every older date still holding
+// snapshots, so one left unverified is not forgotten once it falls outside
+// catch-up; its archive check alone gates the deletion (backfill can rebuild
+// its aggregates from the archive). With dryRun it only reports what would
+// be deleted.
+func runCleanupPositions(ctx context.Context, store objectStore, date time.Time, sweepOlder, dryRun bool) error {
 	startTime := time.Now()
 
 	// Keep 2 days of snapshots (today + yesterday) so aggregate can still run
 	cutoff := time.Now().UTC().AddDate(0, 0, -2)
 	cutoff = time.Date(cutoff.Year(), cutoff.Month(), cutoff.Day(), 0, 0, 0, 0, time.UTC)
 
-	keys, err := listSnapshotKeysForCleanup(ctx, r2, bucket, cutoff)
+	var keys []string
+	var err error
+	scope := "older than " + cutoff.Format("2006-01-02")
+	if date.IsZero() {
+		keys, err = listSnapshotKeysForCleanup(ctx, store, cutoff)
+	} else {
+		day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+		if !day.Before(cutoff) {
+			return fmt.Errorf("refusing to delete snapshots for %s: only dates before %s can be cleaned up",
+				day.Format("2006-01-02"), cutoff.Format("2006-01-02"))
+		}
+		if sweepOlder {
+			scope = "through " + day.Format("2006-01-02")
+			keys, err = listSnapshotKeysForCleanup(ctx, store, day.AddDate(0, 0, 1))
+		} else {
+			scope = "for " + day.Format("2006-01-02")
+			keys, err = listSnapshotKeys(ctx, store, day.Format("2006-01-02"))
+		}
+	}
 	if err != nil {
 		return fmt.Errorf("list old snapshots: %w", err)
 	}
 
 	if len(keys) == 0 {
-		log.Printf("[cleanup] No snapshots older than %s to delete", cutoff.Format("2006-01-02"))
+		logger(ctx).Info("no snapshots to delete", "scope", scope)
 		return nil
 	}
 
-	// Delete in batches (S3 DeleteObjects supports up to 1000 per call,
-	// but we'll do one-by-one for simplicity since this runs once/day)
+	keysByDate := make(map[string][]string)
+	for _, k := range keys {
+		if d, ok := snapshotKeyDate(k); ok {
+			keysByDate[d] = append(keysByDate[d], k)
+		}
+	}
+	dates := make([]string, 0, len(keysByDate))
+	for d := range keysByDate {
+		dates = append(dates, d)
+	}
+	sort.Strings(dates)
+
 	deleted := 0
-	for _, key := range keys {
-		k := key
-		_, err := r2.DeleteObject(ctx, &s3.DeleteObjectInput{
-			Bucket: &bucket,
-			Key:    &k,
-		})
-		if err != nil {
-			log.Printf("[cleanup] WARNING: failed to delete %s: %v", key, err)
+	var unverified []string
+	for _, d := range dates {
+		dayKeys := keysByDate[d]
+		if err := verifyArchive(ctx, store, d, dayKeys); err != nil {
+			logger(ctx).Warn("archive not verified, keeping snapshots", "date", d, "files", len(dayKeys), "error", err)
+			unverified = append(unverified, d)
 			continue
 		}
-		deleted++
+		if dryRun {
+			logger(ctx).Info("dry run: archive verified, would delete snapshots", "date", d, "files", len(dayKeys))
+			deleted += len(dayKeys)
+			continue
+		}
+		n, err := store.Delete(ctx, dayKeys)
+		deleted += n
+		if err != nil {
+			return fmt.Errorf("delete snapshots for %s: %w", d, err)
+		}
 	}
 
 	elapsed := time.Since(startTime)
-	log.Printf("[cleanup] Deleted %d snapshot objects older than %s in %s",
-		deleted, cutoff.Format("2006-01-02"), elapsed)
+	if dryRun {
+		logger(ctx).Info("dry run complete", "scope", scope, "wouldDelete", deleted, "unverifiedDates", len(unverified))
+	} else {
+		logger(ctx).Info("cleanup complete", "scope", scope, "deleted", deleted, "duration", elapsed)
+	}
+	if len(unverified) > 0 {
+		return fmt.Errorf("kept snapshots for %d dates without a verified archive: %s",
+			len(unverified), strings.Join(unverified, ", "))
+	}
+	return nil
+}
+
+// snapshotKeyDate returns the YYYY-MM-DD of a snapshots/YYYY/MM/DD/... key.
+func snapshotKeyDate(key string) (string, bool) {
+	parts := strings.Split(strings.TrimPrefix(key, "snapshots/"), "/")
+	if len(parts) < 4 {
+		return "", false
+	}
+	d := parts[0] + "-" + parts[1] + "-" + parts[2]
+	if _, err := time.Parse("2006-01-02", d); err != nil {
+		return "", false
+	}
+	return d, true
+}
+
+// verifyArchive checks that the daily archive for dateStr exists and covers
+// the snapshot objects at keys. Its "snapshots" metadata must count at least
+// that many files. Archives written before that metadata existed are checked
+// by position instead: their "rows" metadata must be at least the number of
+// positions the snapshots hold. An archive that falls short (e.g. snapshots
+// were spooled in after it was written) stays unverified until it is rebuilt
+// with "archive --rearchive".
+func verifyArchive(ctx context.Context, store objectStore, dateStr string, keys []string) error {
+	key := fmt.Sprintf("positions/%s.parquet", strings.ReplaceAll(dateStr, "-", "/"))
+	head, err := store.Head(ctx, key)
+	if err != nil {
+		return fmt.Errorf("no archive at %s: %w", key, err)
+	}
+
+	rows, err := strconv.Atoi(head.Metadata["rows"])
+	if err != nil || rows <= 0 {
+		return fmt.Errorf("%s has no row count (rows=%q)", key, head.Metadata["rows"])
+	}
+	if s, ok := head.Metadata["snapshots"]; ok {
+		archived, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("%s has an invalid snapshot count %q", key, s)
+		}
+		if archived < len(keys) {
+			return fmt.Errorf("%s covers %d snapshots but %d exist; rebuild it with archive --date %s --rearchive",
+				key, archived, len(keys), dateStr)
+		}
+		return nil
+	}
+	positions, err := countSnapshotPositions(ctx, store, keys)
+	if err != nil {
+		return fmt.Errorf("count positions to check %s against: %w", key, err)
+	}
+	if rows < positions {
+		return fmt.Errorf("%s has %d rows for %d positions; rebuild it with archive --date %s --rearchive",
+			key, rows, positions, dateStr)
+	}
 	return nil
 }
+
+// countSnapshotPositions returns how many positions the snapshot objects at
+// keys hold, counting only the cycles archiveSnapshots would write.
+func countSnapshotPositions(ctx context.Context, store objectStore, keys []string) (int, error) {
+	positions := 0
+	for _, key := range keys {
+		snaps, err := readSnapshots(ctx, store, key)
+		if err != nil {
+			return 0, fmt.Errorf("read %s: %w", key, err)
+		}
+		for _, snap := range snaps {
+			if _, err := time.Parse(time.RFC3339, snap.RecordedAt); err == nil {
+				positions += len(snap.Positions)
+			}
+		}
+	}
+	return positions, nil
+}
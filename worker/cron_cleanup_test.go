@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// putTestSnapshot writes a per-cycle snapshot recorded at at, with one
+// position per vehicle, the way the collector does.
+func putTestSnapshot(t *testing.T, store objectStore, at time.Time, vehicles ...string) string {
+	t.Helper()
+	snap := SnapshotFile{RecordedAt: at.Format(time.RFC3339)}
+	for i, v := range vehicles {
+		snap.Positions = append(snap.Positions, SnapshotPosition{VehicleID: v, Route: "205", Lat: 41.1 + float64(i)/100, Lon: -8.6})
+	}
+	body, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, encoding, err := encodeSnapshot(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := fmt.Sprintf("snapshots/%s.json", at.Format("2006/01/02/150405"))
+	if err := store.Put(context.Background(), key, body, putOptions{ContentType: "application/json", ContentEncoding: encoding}); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func listKeys(t *testing.T, store objectStore, prefix string) []string {
+	t.Helper()
+	keys, err := store.List(context.Background(), prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestCleanupKeepsUnverifiedDates(t *testing.T) {
+	ctx := context.Background()
+	store := newTestLocalStore(t)
+	archived := time.Date(2025, 1, 30, 0, 0, 0, 0, time.UTC)
+	unarchived := archived.AddDate(0, 0, 1)
+	putTestSnapshot(t, store, archived.Add(10*time.Hour), "a", "b")
+	putTestSnapshot(t, store, archived.Add(11*time.Hour), "a")
+	putTestSnapshot(t, store, unarchived.Add(10*time.Hour), "a")
+	if err := runArchivePositions(ctx, store, archived, false); err != nil {
+		t.Fatal(err)
+	}
+
+	err := runCleanupPositions(ctx, store, time.Time{}, false, true)
+	if err == nil || !strings.Contains(err.Error(), "2025-01-31") {
+		t.Errorf("dry run: error %v, want the unarchived date reported", err)
+	}
+	if got := listKeys(t, store, "snapshots/"); len(got) != 3 {
+		t.Errorf("dry run deleted snapshots, %d left", len(got))
+	}
+
+	if err := runCleanupPositions(ctx, store, time.Time{}, false, false); err == nil {
+		t.Error("cleanup succeeded with an unarchived date")
+	}
+	if got := listKeys(t, store, "snapshots/2025/01/30/"); len(got) != 0 {
+		t.Errorf("archived date kept %q", got)
+	}
+	if got := listKeys(t, store, "snapshots/2025/01/31/"); len(got) != 1 {
+		t.Errorf("unarchived date: %d snapshots left, want 1", len(got))
+	}
+	if got := listKeys(t, store, "positions/2025/01/30.parquet"); len(got) != 1 {
+		t.Error("archive deleted")
+	}
+}
+
+func TestCleanupSweepsOlderDates(t *testing.T) {
+	ctx := context.Background()
+	store := newTestLocalStore(t)
+	older := time.Date(2025, 1, 28, 0, 0, 0, 0, time.UTC)
+	target := older.AddDate(0, 0, 2)
+	putTestSnapshot(t, store, older.Add(time.Hour), "a")
+	putTestSnapshot(t, store, target.Add(time.Hour), "a")
+	for _, d := range []time.Time{older, target} {
+		if err := runArchivePositions(ctx, store, d, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := runCleanupPositions(ctx, store, target, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := listKeys(t, store, "snapshots/"); len(got) != 1 {
+		t.Errorf("without sweepOlder: %d snapshots left, want the older date's 1", len(got))
+	}
+	if err := runCleanupPositions(ctx, store, target, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := listKeys(t, store, "snapshots/"); len(got) != 0 {
+		t.Errorf("with sweepOlder: %q left", got)
+	}
+}
+
+func TestVerifyArchive(t *testing.T) {
+	ctx := context.Background()
+	day := time.Date(2025, 1, 30, 0, 0, 0, 0, time.UTC)
+	const archiveKey = "positions/2025/01/30.parquet"
+
+	t.Run("legacy archive checked by positions", func(t *testing.T) {
+		store := newTestLocalStore(t)
+		keys := []string{
+			putTestSnapshot(t, store, day.Add(time.Hour), "a", "b"),
+			putTestSnapshot(t, store, day.Add(2*time.Hour), "a", "b"),
+		}
+		// Four positions in two files: a rows-vs-files check would pass at 2.
+		for rows, wantOK := range map[string]bool{"3": false, "4": true} {
+			if err := store.Put(ctx, archiveKey, []byte("PAR1"), putOptions{Metadata: map[string]string{"rows": rows}}); err != nil {
+				t.Fatal(err)
+			}
+			if err := verifyArchive(ctx, store, "2025-01-30", keys); (err == nil) != wantOK {
+				t.Errorf("rows=%s: verifyArchive = %v, want ok %v", rows, err, wantOK)
+			}
+		}
+	})
+
+	t.Run("late snapshot until rearchived", func(t *testing.T) {
+		store := newTestLocalStore(t)
+		putTestSnapshot(t, store, day.Add(time.Hour), "a")
+		if err := runArchivePositions(ctx, store, day, false); err != nil {
+			t.Fatal(err)
+		}
+		// Uploaded from the spool after the archive was written.
+		putTestSnapshot(t, store, day.Add(2*time.Hour), "a")
+		keys := listKeys(t, store, "snapshots/2025/01/30/")
+
+		err := verifyArchive(ctx, store, "2025-01-30", keys)
+		if err == nil || !strings.Contains(err.Error(), "--rearchive") {
+			t.Fatalf("verifyArchive = %v, want a rearchive hint", err)
+		}
+		if err := runArchivePositions(ctx, store, day, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := verifyArchive(ctx, store, "2025-01-30", keys); err == nil {
+			t.Error("archive replaced without --rearchive")
+		}
+		if err := runArchivePositions(ctx, store, day, true); err != nil {
+			t.Fatal(err)
+		}
+		if err := verifyArchive(ctx, store, "2025-01-30", keys); err != nil {
+			t.Errorf("after rearchive: %v", err)
+		}
+	})
+}
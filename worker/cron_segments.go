@@ -6,7 +6,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"math"
 	"net/http"
 	"time"
@@ -61,7 +60,7 @@ func fetchWithRetry(ctx context.Context, url string, body []byte, maxRetries int
 
 func runRefreshSegments(ctx context.Context, pool *pgxpool.Pool) error {
 	startTime := time.Now()
-	log.Println("[segments] Refreshing route segments from OTP...")
+	logger(ctx).Info("refreshing route segments from OTP")
 
 	query := `query {
 		routes {
@@ -124,7 +123,7 @@ func runRefreshSegments(ctx context.Context, pool *pgxpool.Pool) error {
 			// Decode polyline
 			coords, _, err := polyline.DecodeCoords([]byte(pattern.PatternGeometry.Points))
 			if err != nil {
-				log.Printf("[segments] Failed to decode polyline for %s:%d: %v", route.ShortName, pattern.DirectionID, err)
+				logger(ctx).Warn("failed to decode polyline", "route", route.ShortName, "direction", pattern.DirectionID, "error", err)
 				continue
 			}
 
@@ -151,7 +150,7 @@ func runRefreshSegments(ctx context.Context, pool *pgxpool.Pool) error {
 					seg.StartLat, seg.StartLon, seg.EndLat, seg.EndLon,
 					seg.MidLat, seg.MidLon, seg.LengthM, string(geomJSON))
 				if err != nil {
-					log.Printf("[segments] Failed to upsert segment %s: %v", seg.ID, err)
+					logger(ctx).Warn("failed to upsert segment", "segment", seg.ID, "error", err)
 					continue
 				}
 			}
@@ -177,13 +176,13 @@ func runRefreshSegments(ctx context.Context, pool *pgxpool.Pool) error {
 						lat = EXCLUDED.lat, lon = EXCLUDED.lon
 				`, stopID, route.ShortName, pattern.DirectionID, seq, stop.GtfsID, stopName, stop.Lat, stop.Lon)
 				if err != nil {
-					log.Printf("[segments] Failed to upsert stop %s: %v", stopID, err)
+					logger(ctx).Warn("failed to upsert stop", "stop", stopID, "error", err)
 				}
 			}
 		}
 	}
 
 	elapsed := time.Since(startTime)
-	log.Printf("[segments] Refreshed %d segments from %d routes in %s", totalSegments, len(routes), elapsed)
+	logger(ctx).Info("route segments refreshed", "segments", totalSegments, "routes", len(routes), "duration", elapsed)
 	return nil
 }
@@ -6,7 +6,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"strings"
 	"time"
@@ -39,26 +38,30 @@ type otpSnapshotTrip struct {
 }
 
 // runSnapshotSchedule queries OTP for today's scheduled trips and stores them in ScheduledTripDaily.
-// Runs at 01:00 UTC — before Porto service starts in both WET (UTC+0) and WEST (UTC+1).
+// Runs at 01:00 Europe/Lisbon — after the local service day starts, before service does.
+// A non-zero date selects that service day instead of today.
 //
 // canceledPct computed from this data is an upper bound: GPS gaps (vehicle with no FIWARE signal)
 // are indistinguishable from true cancellations.
-func runSnapshotSchedule(ctx context.Context, pool *pgxpool.Pool) error {
+func runSnapshotSchedule(ctx context.Context, pool *pgxpool.Pool, date time.Time) error {
 	startTime := time.Now()
 
 	// Compute today's local midnight in Porto timezone (Europe/Lisbon)
 	loc, err := time.LoadLocation("Europe/Lisbon")
 	if err != nil {
 		// Fallback to UTC+0 (WET) if tz data unavailable
-		log.Printf("[snapshot] WARNING: could not load Europe/Lisbon tz: %v — falling back to UTC", err)
+		logger(ctx).Warn("could not load Europe/Lisbon tz, falling back to UTC", "error", err)
 		loc = time.UTC
 	}
 	localNow := time.Now().In(loc)
+	if !date.IsZero() {
+		localNow = time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, loc)
+	}
 	localMidnight := time.Date(localNow.Year(), localNow.Month(), localNow.Day(), 0, 0, 0, 0, loc)
 	targetEpoch := localMidnight.Unix()
 	dateStr := localMidnight.Format("2006-01-02")
 
-	log.Printf("[snapshot] Fetching OTP timetable for %s (epoch %d)", dateStr, targetEpoch)
+	logger(ctx).Info("fetching OTP timetable", "date", dateStr, "epoch", targetEpoch)
 
 	// Query OTP for all routes with their patterns and trips
 	query := `{
@@ -102,7 +105,7 @@ func runSnapshotSchedule(ctx context.Context, pool *pgxpool.Pool) error {
 	}
 
 	if len(otpResp.Data.Routes) == 0 {
-		log.Printf("[snapshot] No routes returned from OTP")
+		logger(ctx).Warn("no routes returned from OTP", "date", dateStr)
 		return nil
 	}
 
@@ -134,14 +137,14 @@ func runSnapshotSchedule(ctx context.Context, pool *pgxpool.Pool) error {
 		}
 	}
 
-	log.Printf("[snapshot] Found %d scheduled trips for %s across %d routes", len(rows), dateStr, len(otpResp.Data.Routes))
+	logger(ctx).Info("scheduled trips found", "date", dateStr, "trips", len(rows), "routes", len(otpResp.Data.Routes))
 
 	if len(rows) == 0 {
-		log.Printf("[snapshot] No active trips found for %s — skipping insert", dateStr)
+		logger(ctx).Info("no active trips, skipping insert", "date", dateStr)
 		return nil
 	}
 
-	// Idempotent: delete existing rows for today
+	// Idempotent: delete existing rows for the date
 	targetDate := time.Date(localNow.Year(), localNow.Month(), localNow.Day(), 0, 0, 0, 0, time.UTC)
 	_, err = pool.Exec(ctx, `DELETE FROM "ScheduledTripDaily" WHERE date = $1`, targetDate)
 	if err != nil {
@@ -173,6 +176,6 @@ func runSnapshotSchedule(ctx context.Context, pool *pgxpool.Pool) error {
 	}
 
 	elapsed := time.Since(startTime)
-	log.Printf("[snapshot] Complete for %s: %d trips stored in %s", dateStr, len(rows), elapsed)
+	logger(ctx).Info("schedule snapshot complete", "date", dateStr, "trips", len(rows), "duration", elapsed)
 	return nil
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"time"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"google.golang.org/protobuf/proto"
+)
+
+// gtfsrtFeedKey is where each cycle's GTFS-RT VehiclePositions feed is published.
+const gtfsrtFeedKey = "realtime/vehicle_positions.pb"
+
+// encodeVehiclePositions builds a full-dataset GTFS-RT FeedMessage from a
+// cycle's parsed rows. Speeds are converted from km/h back to m/s, and each
+// vehicle carries its own observation time when the source reported one.
+func encodeVehiclePositions(rows []*positionRow, now time.Time) ([]byte, error) {
+	feed := &gtfs.FeedMessage{
+		Header: &gtfs.FeedHeader{
+			GtfsRealtimeVersion: proto.String("2.0"),
+			Incrementality:      gtfs.FeedHeader_FULL_DATASET.Enum(),
+			Timestamp:           proto.Uint64(uint64(now.Unix())),
+		},
+		Entity: make([]*gtfs.FeedEntity, 0, len(rows)),
+	}
+
+	for _, r := range rows {
+		observedAt := now
+		if r.observedAt != nil {
+			observedAt = *r.observedAt
+		}
+
+		vp := &gtfs.VehiclePosition{
+			Vehicle: &gtfs.VehicleDescriptor{
+				Id: proto.String(r.vehicleID),
+			},
+			Position: &gtfs.Position{
+				Latitude:  proto.Float32(float32(r.lat)),
+				Longitude: proto.Float32(float32(r.lon)),
+			},
+			Timestamp: proto.Uint64(uint64(observedAt.Unix())),
+		}
+		if r.vehicleNum != nil {
+			vp.Vehicle.Label = proto.String(*r.vehicleNum)
+		}
+		if r.speed != nil && *r.speed >= 0 {
+			vp.Position.Speed = proto.Float32(*r.speed / 3.6)
+		}
+		if r.heading != nil && *r.heading >= 0 {
+			vp.Position.Bearing = proto.Float32(*r.heading)
+		}
+		if r.route != nil || r.tripID != nil {
+			vp.Trip = &gtfs.TripDescriptor{}
+			if r.route != nil {
+				vp.Trip.RouteId = proto.String(*r.route)
+			}
+			if r.tripID != nil {
+				vp.Trip.TripId = proto.String(*r.tripID)
+			}
+			if r.directionID != nil && *r.directionID >= 0 {
+				vp.Trip.DirectionId = proto.Uint32(uint32(*r.directionID))
+			}
+		}
+
+		feed.Entity = append(feed.Entity, &gtfs.FeedEntity{
+			Id:      proto.String(r.vehicleID),
+			Vehicle: vp,
+		})
+	}
+
+	return proto.Marshal(feed)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// defaultReadyWindow is how long /readyz tolerates going without a successful
+// collection cycle unless READY_WINDOW overrides it (10 missed cycles).
+const defaultReadyWindow = 5 * time.Minute
+
+// workerHealth tracks the collection loop for /healthz and /readyz. The
+// timestamps are Unix nanoseconds, 0 until the first event.
+type workerHealth struct {
+	started     time.Time
+	window      time.Duration
+	lastCycle   atomic.Int64 // any completed cycle, successful or not
+	lastSuccess atomic.Int64
+	lastR2Write atomic.Int64
+
+	pool   *pgxpool.Pool
+	runner *jobRunner
+}
+
+// health is set up by runCollector; one-shot commands leave it nil.
+var health *workerHealth
+
+func newWorkerHealth(pool *pgxpool.Pool, runner *jobRunner) *workerHealth {
+	return &workerHealth{
+		started: time.Now(),
+		window:  envDuration("READY_WINDOW", defaultReadyWindow),
+		pool:    pool,
+		runner:  runner,
+	}
+}
+
+func (h *workerHealth) cycleDone(err error) {
+	now := time.Now().UnixNano()
+	h.lastCycle.Store(now)
+	if err == nil {
+		h.lastSuccess.Store(now)
+	}
+}
+
+func (h *workerHealth) r2Written() {
+	h.lastR2Write.Store(time.Now().UnixNano())
+}
+
+type healthReport struct {
+	Status        string     `json:"status"`
+	Reason        string     `json:"reason,omitempty"`
+	Uptime        string     `json:"uptime"`
+	LastCycle     *time.Time `json:"lastCycle"`
+	LastSuccess   *time.Time `json:"lastSuccess"`
+	LastR2Write   *time.Time `json:"lastR2Write"`
+	Database      string     `json:"database"`
+	DatabaseConns int32      `json:"databaseConns,omitempty"`
+	RunningJobs   []string   `json:"runningJobs"`
+	ReadyWindow   string     `json:"readyWindow"`
+}
+
+func (h *workerHealth) report(ctx context.Context) healthReport {
+	r := healthReport{
+		Status:      "ok",
+		Uptime:      time.Since(h.started).Round(time.Second).String(),
+		LastCycle:   unixNanoTime(h.lastCycle.Load()),
+		LastSuccess: unixNanoTime(h.lastSuccess.Load()),
+		LastR2Write: unixNanoTime(h.lastR2Write.Load()),
+		Database:    "not configured",
+		RunningJobs: h.runner.runningJobs(),
+		ReadyWindow: h.window.String(),
+	}
+	if h.pool != nil {
+		pingCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		if err := h.pool.Ping(pingCtx); err != nil {
+			r.Database = "error: " + err.Error()
+		} else {
+			r.Database = "ok"
+		}
+		r.DatabaseConns = h.pool.Stat().TotalConns()
+	}
+	return r
+}
+
+// stalled reports whether the event at ts (Unix nanoseconds, 0 = never) is
+// older than the window, counting from startup if it never happened.
+func (h *workerHealth) stalled(ts int64) bool {
+	since := h.started
+	if ts != 0 {
+		since = time.Unix(0, ts)
+	}
+	return time.Since(since) > h.window
+}
+
+// handleHealthz is the liveness check: it fails only when the collection
+// loop has not completed any cycle within the window, i.e. it is hung (for
+// example on a FIWARE request that never returns) rather than just failing.
+func (h *workerHealth) handleHealthz(w http.ResponseWriter, req *http.Request) {
+	r := h.report(req.Context())
+	if h.stalled(h.lastCycle.Load()) {
+		r.Status = "stalled"
+		r.Reason = "no collection cycle completed within " + h.window.String()
+	}
+	writeHealth(w, r)
+}
+
+// handleReadyz is the readiness check: it fails when no cycle has succeeded
+// within the window (including before the first success after startup).
+func (h *workerHealth) handleReadyz(w http.ResponseWriter, req *http.Request) {
+	r := h.report(req.Context())
+	if h.lastSuccess.Load() == 0 || h.stalled(h.lastSuccess.Load()) {
+		r.Status = "not ready"
+		r.Reason = "no successful collection cycle within " + h.window.String()
+	}
+	writeHealth(w, r)
+}
+
+func writeHealth(w http.ResponseWriter, r healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(r)
+}
+
+func unixNanoTime(ns int64) *time.Time {
+	if ns == 0 {
+		return nil
+	}
+	t := time.Unix(0, ns).UTC()
+	return &t
+}
+
+// runningJobs returns the names of the jobs currently in flight.
+func (r *jobRunner) runningJobs() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.running))
+	for name := range r.running {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
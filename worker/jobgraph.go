@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// upstreamError reports a run that was skipped because a job it requires
+// has not succeeded for the same target date.
+type upstreamError struct {
+	upstream string
+	target   jobTarget
+	status   string // latest status of the upstream run, "" if it never ran
+}
+
+func (e *upstreamError) Error() string {
+	if e.status == "" {
+		return fmt.Sprintf("upstream %s has not run for %s", e.upstream, e.target)
+	}
+	return fmt.Sprintf("upstream %s has not succeeded for %s (last run %s)", e.upstream, e.target, e.status)
+}
+
+// validateJobGraph checks that every job named in after or requires exists,
+// that requires only links daily jobs (whose targets are comparable dates),
+// and that the dependencies form no cycle.
+func validateJobGraph(jobs []scheduledJob) error {
+	byName := make(map[string]*scheduledJob, len(jobs))
+	for i := range jobs {
+		byName[jobs[i].name] = &jobs[i]
+	}
+	for i := range jobs {
+		job := &jobs[i]
+		for _, dep := range job.dependencies() {
+			if byName[dep] == nil {
+				return fmt.Errorf("job %s depends on unknown job %s", job.name, dep)
+			}
+		}
+		for _, req := range job.requires {
+			if job.hourly || byName[req].hourly {
+				return fmt.Errorf("job %s requires %s: requirements only link daily jobs", job.name, req)
+			}
+		}
+	}
+
+	// Depth-first search; a job met again while on the stack closes a cycle.
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(jobs))
+	var stack []string
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			for i, n := range stack {
+				if n == name {
+					return fmt.Errorf("job dependency cycle: %s -> %s", strings.Join(stack[i:], " -> "), name)
+				}
+			}
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		stack = append(stack, name)
+		for _, dep := range byName[name].dependencies() {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = visited
+		return nil
+	}
+	for i := range jobs {
+		if err := visit(jobs[i].name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dependencies returns every job j waits for: after and requires.
+func (j *scheduledJob) dependencies() []string {
+	return append(append([]string(nil), j.after...), j.requires...)
+}
+
+// checkRequires returns an *upstreamError for the first job in job.requires
+// without a successful run for t. Without a database, or if the runs cannot
+// be read (e.g. the table is missing), nothing can be checked and the job
+// runs, as it did before runs were recorded.
+func (s *jobRunStore) checkRequires(ctx context.Context, job *scheduledJob, t jobTarget) error {
+	if s.db == nil {
+		return nil
+	}
+	for _, req := range job.requires {
+		// A success if there is one, otherwise the latest attempt.
+		var status string
+		err := s.db.QueryRow(ctx, `
+			SELECT status FROM "WorkerJobRun"
+			WHERE job = $1 AND "targetDate" = $2::date
+			ORDER BY status = 'succeeded' DESC, "startedAt" DESC
+			LIMIT 1
+		`, req, t.date).Scan(&status)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			logger(ctx).Warn("could not check upstream runs, running anyway", "upstream", req, "error", err)
+			return nil
+		}
+		if status != "succeeded" {
+			return &upstreamError{upstream: req, target: t, status: status}
+		}
+	}
+	return nil
+}
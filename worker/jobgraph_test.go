@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// fakeJobRunDB is a jobRunDB whose upstream lookups return status (no rows
+// if it is empty, err if set) and which records the outcome of each run.
+type fakeJobRunDB struct {
+	status   string
+	err      error
+	recorded []string
+}
+
+type fakeRow func(dest ...any) error
+
+func (r fakeRow) Scan(dest ...any) error { return r(dest...) }
+
+func (f *fakeJobRunDB) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	if strings.Contains(sql, "INSERT") {
+		return fakeRow(func(dest ...any) error {
+			*dest[0].(*int64) = int64(len(f.recorded) + 1)
+			return nil
+		})
+	}
+	return fakeRow(func(dest ...any) error {
+		switch {
+		case f.err != nil:
+			return f.err
+		case f.status == "":
+			return pgx.ErrNoRows
+		}
+		*dest[0].(*string) = f.status
+		return nil
+	})
+}
+
+func (f *fakeJobRunDB) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (f *fakeJobRunDB) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	f.recorded = append(f.recorded, args[1].(string))
+	return pgconn.CommandTag{}, nil
+}
+
+func TestValidateJobGraph(t *testing.T) {
+	tests := []struct {
+		name    string
+		jobs    []scheduledJob
+		wantErr string
+	}{
+		{
+			name: "valid",
+			jobs: []scheduledJob{
+				{name: "archive-hourly", hourly: true},
+				{name: "archive-positions", after: []string{"archive-hourly"}},
+				{name: "aggregate-daily"},
+				{name: "cleanup-positions", requires: []string{"archive-positions", "aggregate-daily"}},
+			},
+		},
+		{
+			name:    "unknown after",
+			jobs:    []scheduledJob{{name: "archive-positions", after: []string{"archive-hourly"}}},
+			wantErr: "depends on unknown job archive-hourly",
+		},
+		{
+			name:    "unknown requires",
+			jobs:    []scheduledJob{{name: "cleanup-positions", requires: []string{"archive-positions"}}},
+			wantErr: "depends on unknown job archive-positions",
+		},
+		{
+			name: "requires an hourly job",
+			jobs: []scheduledJob{
+				{name: "archive-hourly", hourly: true},
+				{name: "cleanup-positions", requires: []string{"archive-hourly"}},
+			},
+			wantErr: "requirements only link daily jobs",
+		},
+		{
+			name: "cycle",
+			jobs: []scheduledJob{
+				{name: "a", after: []string{"c"}},
+				{name: "b", after: []string{"a"}},
+				{name: "c", requires: []string{"b"}},
+			},
+			wantErr: "cycle: a -> c -> b -> a",
+		},
+		{
+			name:    "self",
+			jobs:    []scheduledJob{{name: "a", requires: []string{"a"}}},
+			wantErr: "cycle: a -> a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateJobGraph(tt.jobs)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateJobGraph = %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateJobGraph = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunJobChecksRequires(t *testing.T) {
+	tests := []struct {
+		name         string
+		db           *fakeJobRunDB
+		wantRun      bool
+		wantRecorded string
+	}{
+		{"upstream succeeded", &fakeJobRunDB{status: "succeeded"}, true, "succeeded"},
+		{"upstream never ran", &fakeJobRunDB{}, false, "skipped"},
+		{"upstream failed", &fakeJobRunDB{status: "failed"}, false, "skipped"},
+		// E.g. WorkerJobRun is missing: run as before runs were recorded.
+		{"history unreadable", &fakeJobRunDB{err: errors.New(`relation "WorkerJobRun" does not exist`)}, true, "succeeded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ran := false
+			job := &scheduledJob{name: "cleanup-positions", requires: []string{"archive-positions"}, fn: func(context.Context, time.Time) error {
+				ran = true
+				return nil
+			}}
+			err := runJob(context.Background(), &jobRunStore{db: tt.db}, job, testTarget, time.Time{}, true)
+			if ran != tt.wantRun {
+				t.Errorf("job ran: %v, want %v", ran, tt.wantRun)
+			}
+			var upstream *upstreamError
+			if isUpstream := errors.As(err, &upstream); isUpstream == tt.wantRun {
+				t.Errorf("runJob = %v", err)
+			} else if isUpstream && (upstream.upstream != "archive-positions" || upstream.status != tt.db.status) {
+				t.Errorf("upstreamError = %+v", upstream)
+			}
+			if len(tt.db.recorded) != 1 || tt.db.recorded[0] != tt.wantRecorded {
+				t.Errorf("recorded %q, want %q", tt.db.recorded, tt.wantRecorded)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// setupLogging installs the default slog logger: LOG_FORMAT=json for one JSON
+// object per line (default: logfmt-style text), LOG_LEVEL=debug|info|warn|error
+// (default info). Anything still using the log package goes through it too.
+func setupLogging() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(envOr("LOG_LEVEL", "info"))); err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: invalid LOG_LEVEL=%q — using info\n", os.Getenv("LOG_LEVEL"))
+		level = slog.LevelInfo
+	}
+	opts := &slog.HandlerOptions{
+		Level: level,
+		// Durations as "1.5s" rather than JSON nanosecond integers.
+		ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+			if a.Value.Kind() == slog.KindDuration {
+				a.Value = slog.StringValue(a.Value.Duration().String())
+			}
+			return a
+		},
+	}
+
+	var handler slog.Handler
+	switch format := strings.ToLower(envOr("LOG_FORMAT", "text")); format {
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	default:
+		fmt.Fprintf(os.Stderr, "WARNING: invalid LOG_FORMAT=%q — using text\n", format)
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+type loggerKey struct{}
+
+// withLog returns ctx carrying a logger with args added, so everything logged
+// below (a job run, a collection cycle) shares its fields.
+func withLog(ctx context.Context, args ...any) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger(ctx).With(args...))
+}
+
+// logger returns the logger carried by ctx, or the default one.
+func logger(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// fatal logs msg at error level and exits, like log.Fatalf.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
@@ -2,143 +2,214 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
+
+	"github.com/robfig/cron/v3"
 )
 
 const (
-	fiwareURL  = "https://broker.fiware.urbanplatform.portodigital.pt/v2/entities?q=vehicleType==bus&limit=1000"
 	intervalMs = 30_000
 	batchSize  = 100
 )
 
 // Scheduled job definition
 type scheduledJob struct {
-	name      string
-	hour      int
-	dayOfWeek *time.Weekday // nil = daily
-	fn        func(ctx context.Context) error
+	name       string
+	spec       string        // cron expression in the schedule timezone (SCHEDULE_<NAME> overrides)
+	schedule   cron.Schedule // parsed spec, set by configureSchedules; nil = not scheduled
+	hourly     bool          // each run covers the previous UTC hour rather than a day
+	dated      bool          // fn honours a target date (hour, for hourly jobs); zero means the job's default
+	needsDB    bool
+	needsStore bool
+	// targetOffset is the target date of a daily run relative to the day it
+	// fires on (e.g. -1 for jobs that process yesterday).
+	targetOffset int
+	after        []string      // jobs whose in-flight runs this one waits for
+	requires     []string      // jobs that must have succeeded for the same target date
+	timeout      time.Duration // 0 = defaultJobTimeout
+	fn           func(ctx context.Context, date time.Time) error
+}
+
+// newJobs returns the scheduled jobs bound to env. They read its connections
+// when they run, so the list can be built (to validate or list it) before
+// env is connected.
+func newJobs(env *workerEnv) []scheduledJob {
+	return []scheduledJob{
+		{name: "snapshot-schedule", spec: "0 1 * * *", dated: true, needsDB: true, timeout: 10 * time.Minute, fn: func(ctx context.Context, date time.Time) error {
+			return runSnapshotSchedule(ctx, env.pool, date)
+		}},
+		{name: "aggregate-daily", spec: "0 3 * * *", dated: true, needsDB: true, needsStore: true, targetOffset: -1, after: []string{"snapshot-schedule"}, timeout: time.Hour, fn: func(ctx context.Context, date time.Time) error {
+			return runAggregateDailyIncremental(ctx, env.pool, env.store, date)
+		}},
+		{name: "archive-hourly", spec: "0 * * * *", hourly: true, dated: true, needsStore: true, timeout: 15 * time.Minute, fn: func(ctx context.Context, hour time.Time) error {
+			if hour.IsZero() {
+				hour = time.Now().UTC().Truncate(time.Hour).Add(-time.Hour)
+			}
+			return archiveHour(ctx, env.store, hour)
+		}},
+		{name: "archive-positions", spec: "0 3 * * *", dated: true, needsStore: true, targetOffset: -1, after: []string{"archive-hourly"}, timeout: 45 * time.Minute, fn: func(ctx context.Context, date time.Time) error {
+			return runArchivePositions(ctx, env.store, date, false)
+		}},
+		{name: "cleanup-positions", spec: "0 4 * * *", dated: true, needsStore: true, targetOffset: -3, requires: []string{"archive-positions", "aggregate-daily"}, timeout: 30 * time.Minute, fn: func(ctx context.Context, date time.Time) error {
+			return runCleanupPositions(ctx, env.store, date, true, false)
+		}},
+		{name: "refresh-segments", spec: "0 5 * * 1", needsDB: true, timeout: 20 * time.Minute, fn: func(ctx context.Context, _ time.Time) error {
+			return runRefreshSegments(ctx, env.pool)
+		}},
+	}
 }
 
 func main() {
-	dbURL := os.Getenv("DATABASE_URL")
+	sourceKind := flag.String("source", os.Getenv("FEED_SOURCE"), "vehicle feed source: fiware, gtfs-rt, replay (env FEED_SOURCE)")
+	feedURL := flag.String("feed-url", os.Getenv("FEED_URL"), "feed endpoint, or snapshot directory for replay (env FEED_URL)")
+	ngsiDialect := flag.String("ngsi-dialect", os.Getenv("FIWARE_DIALECT"), "FIWARE broker dialect: v2, ld (env FIWARE_DIALECT)")
+	flag.Usage = usage
+	flag.Parse()
+	setupLogging()
+	args := flag.Args()
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// R2 is required for collection
-	r2, bucket := getR2Client()
-	if r2 == nil {
-		log.Fatal("FATAL: R2 not configured — set R2_ENDPOINT, R2_ACCESS_KEY_ID, R2_SECRET_ACCESS_KEY")
+	cmd := "collect"
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
 	}
+	var err error
+	switch cmd {
+	case "collect":
+		cmdCollect(ctx, args, *sourceKind, *feedURL, *ngsiDialect)
+	case "run":
+		err = cmdRun(ctx, args)
+	case "backfill":
+		err = cmdBackfill(ctx, args)
+	case "list-jobs":
+		cmdListJobs(args)
+	case "archive":
+		err = cmdArchive(ctx, args)
+	case "cleanup":
+		err = cmdCleanup(ctx, args)
+	case "segments":
+		err = cmdSegments(ctx, args)
+	case "help", "-h", "--help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", cmd)
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		// The command has logged why and closed its connections.
+		cancel()
+		os.Exit(1)
+	}
+}
 
-	// DB pool is only needed for scheduled jobs (aggregate, archive, cleanup, segments, snapshot)
-	// Collection loop does not touch the DB.
-	var jobs []scheduledJob
-	if dbURL != "" {
-		pool, err := newPool(ctx, dbURL)
-		if err != nil {
-			log.Fatalf("FATAL: Database connection failed: %v", err)
-		}
-		defer pool.Close()
-
-		var ok int
-		if err := pool.QueryRow(ctx, "SELECT 1 as ok").Scan(&ok); err != nil {
-			log.Fatalf("FATAL: Database ping failed: %v", err)
-		}
-		log.Println("Database connection: OK")
-
-		monday := time.Monday
-		jobs = []scheduledJob{
-			{name: "snapshot-schedule", hour: 1, dayOfWeek: nil, fn: func(ctx context.Context) error {
-				return runSnapshotSchedule(ctx, pool)
-			}},
-			{name: "aggregate-daily", hour: 3, dayOfWeek: nil, fn: func(ctx context.Context) error {
-				return runAggregateDailyIncremental(ctx, pool, r2, bucket, time.Time{})
-			}},
-			{name: "archive-positions", hour: 3, dayOfWeek: nil, fn: func(ctx context.Context) error {
-				return runArchivePositions(ctx, r2, bucket)
-			}},
-			{name: "cleanup-positions", hour: 4, dayOfWeek: nil, fn: func(ctx context.Context) error {
-				return runCleanupPositions(ctx, r2, bucket)
-			}},
-			{name: "refresh-segments", hour: 5, dayOfWeek: &monday, fn: func(ctx context.Context) error {
-				return runRefreshSegments(ctx, pool)
-			}},
-		}
+// runCollector is the long-running mode: collect positions every intervalMs
+// and run scheduled jobs when due, until SIGTERM/SIGINT.
+func runCollector(ctx context.Context, src FeedSource) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-		// --- CLI mode: run a specific job and exit ---
-		if len(os.Args) >= 3 && os.Args[1] == "run" {
-			jobName := os.Args[2]
-			var target *scheduledJob
-			for i := range jobs {
-				if jobs[i].name == jobName {
-					target = &jobs[i]
-					break
-				}
-			}
-			if target == nil {
-				log.Printf("Unknown job: %s", jobName)
-				log.Printf("Available jobs:")
-				for _, j := range jobs {
-					log.Printf("  - %s", j.name)
-				}
-				os.Exit(1)
-			}
+	staleness.maxAge = envDuration("MAX_POSITION_AGE", staleness.maxAge)
+	switch mode := os.Getenv("STALE_POSITIONS"); mode {
+	case "":
+	case "drop", "flag", "keep":
+		staleness.mode = mode
+	default:
+		fatal("invalid STALE_POSITIONS (use drop, flag or keep)", "value", mode)
+	}
+	switch mode := os.Getenv("DUPLICATE_POSITIONS"); mode {
+	case "":
+	case "drop", "flag", "keep":
+		dedup.mode = mode
+	default:
+		fatal("invalid DUPLICATE_POSITIONS (use flag, drop or keep)", "value", mode)
+	}
+	switch mode := os.Getenv("SNAPSHOT_COMPRESSION"); mode {
+	case "":
+	case "gzip", "zstd":
+		snapshotCompression = mode
+	case "none":
+		snapshotCompression = ""
+	default:
+		fatal("invalid SNAPSHOT_COMPRESSION (use gzip, zstd or none)", "value", mode)
+	}
+	snapshotBatchMinutes = envInt("SNAPSHOT_BATCH_MINUTES", 0)
+	if snapshotBatchMinutes > 0 && 60%snapshotBatchMinutes != 0 {
+		fatal("invalid SNAPSHOT_BATCH_MINUTES (must divide 60)", "value", snapshotBatchMinutes)
+	}
 
-			// Support DATE env var for aggregate-daily to backfill historical data
-			if target.name == "aggregate-daily" {
-				if dateStr := os.Getenv("DATE"); dateStr != "" {
-					overrideDate, err := time.Parse("2006-01-02", dateStr)
-					if err != nil {
-						log.Fatalf("[run] Invalid DATE format (use YYYY-MM-DD): %v", err)
-					}
-					log.Printf("[run] Using date override: %s", dateStr)
-					if err := runAggregateDailyIncremental(ctx, pool, r2, bucket, overrideDate); err != nil {
-						log.Fatalf("[run] aggregate-daily failed: %v", err)
-					}
-					log.Printf("[run] aggregate-daily completed successfully")
-					return
-				}
-			}
+	// Object storage (R2, or a local directory) is required for collection. The DB pool is only needed for scheduled
+	// jobs; the collection loop does not touch the DB.
+	env := connect(ctx)
+	defer env.close()
+	if err := env.requireStore("collect"); err != nil {
+		env.close()
+		os.Exit(1)
+	}
 
-			log.Printf("[run] Executing %s...", target.name)
-			if err := target.fn(ctx); err != nil {
-				log.Fatalf("[run] %s failed: %v", target.name, err)
-			}
-			log.Printf("[run] %s completed successfully", target.name)
-			return
+	var jobs []scheduledJob
+	if env.pool != nil {
+		jobs = newJobs(env)
+		if err := validateJobGraph(jobs); err != nil {
+			fatal("invalid job graph", "error", err)
 		}
-	} else {
-		log.Println("WARNING: DATABASE_URL not set — scheduled jobs (aggregate, archive, cleanup) disabled")
-
-		// CLI mode without DATABASE_URL
-		if len(os.Args) >= 3 && os.Args[1] == "run" {
-			log.Fatal("[run] DATABASE_URL not configured — cannot run scheduled jobs that require database")
+		if err := configureSchedules(jobs); err != nil {
+			fatal("invalid job schedules", "error", err)
 		}
+	} else {
+		slog.Warn("DATABASE_URL not set — scheduled jobs (aggregate, archive, cleanup) disabled")
 	}
 
-	maskedURL := maskDatabaseURL(dbURL)
-	log.Println("=== PortoMove Worker (Go) ===")
-	log.Printf("Collection interval: %ds", intervalMs/1000)
-	log.Printf("Database: %s", maskedURL)
-	log.Printf("FIWARE:   %s", fiwareURL)
-	log.Println("Scheduled jobs:")
-	dayNames := []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+	catchUp := 0
+	if env.pool != nil {
+		catchUp = catchUpDays()
+	}
+	slog.Info("PortoMove worker starting",
+		"interval", time.Duration(intervalMs)*time.Millisecond,
+		"database", maskDatabaseURL(os.Getenv("DATABASE_URL")),
+		"storage", env.store.String(),
+		"feed", src.URL(), "source", src.Name(),
+		"staleAfter", staleness.maxAge, "staleMode", staleness.mode,
+		"dedupMode", dedup.mode,
+		"snapshotCompression", snapshotCompression, "snapshotBatchMinutes", snapshotBatchMinutes,
+		"catchUpDays", catchUp)
+	runner := newJobRunner(newJobRunStore(env.pool))
+	health = newWorkerHealth(env.pool, runner)
+	srv := startHTTPServer(health)
+	defer stopHTTPServer(srv)
 	for _, job := range jobs {
-		dayStr := "daily"
-		if job.dayOfWeek != nil {
-			dayStr = dayNames[int(*job.dayOfWeek)]
+		if job.schedule == nil {
+			slog.Info("scheduled job", "job", job.name, "spec", "off")
+			continue
 		}
-		log.Printf("  - %s: %02d:00 UTC (%s)", job.name, job.hour, dayStr)
+		slog.Info("scheduled job", "job", job.name, "spec", job.spec, "tz", scheduleLocation.String(),
+			"next", job.schedule.Next(time.Now()).In(scheduleLocation).Format("2006-01-02 15:04 MST"))
 	}
-	log.Println("")
-	log.Println("Starting main loop...")
+
+	store := env.store
+	spool, err := newSnapshotSpool(ctx, store)
+	if err != nil {
+		slog.Warn("snapshot spool disabled — failed writes will drop their cycle", "error", err)
+	} else {
+		slog.Info("snapshot spool ready", "dir", spool.String(), "pending", spool.len())
+		runner.goRun(func() { spool.run(ctx) })
+	}
+	snapshots := newSnapshotWriter(store, spool, snapshotBatchMinutes)
+	// Pick up today's totals from before a restart before today.json is next written.
+	if err := restoreRollingState(withLog(ctx, "component", "restore"), store); err != nil {
+		slog.Warn("could not restore today's rolling state, continuing with partial totals", "error", err)
+	}
+	slog.Info("starting main loop")
 
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
@@ -147,76 +218,90 @@ func main() {
 	var totalCycles int64
 	var totalErrors int64
 
-	jobLastRun := make(map[string]string)
+	jobNextRun := make(map[string]time.Time)
 
 	ticker := time.NewTicker(time.Duration(intervalMs) * time.Millisecond)
 	defer ticker.Stop()
 
 	// Run first collection immediately
-	collected, err := collectPositions(ctx, r2, bucket)
+	cycle := int64(1)
+	cycleStart := time.Now()
+	cycleCtx := withLog(ctx, "component", "collect", "cycle", cycle)
+	collected, err := collectPositions(cycleCtx, src, store, snapshots)
+	observeCollect(collected, err)
 	if err != nil {
 		totalErrors++
-		log.Printf("[collect] Failed: %v", err)
+		logger(cycleCtx).Error("collection failed", "error", err, "duration", time.Since(cycleStart))
 	} else {
 		totalCollected += int64(collected)
 		totalCycles++
-		log.Printf("[collect] %d positions", collected)
+		logger(cycleCtx).Info("collected positions", "count", collected, "duration", time.Since(cycleStart))
+	}
+	if catchUp > 0 {
+		runner.goRun(func() { catchUpJobs(ctx, jobs, runner, catchUp) })
 	}
-	checkScheduledJobs(ctx, jobs, jobLastRun)
+	checkScheduledJobs(ctx, jobs, jobNextRun, runner)
 
 	for {
 		select {
 		case <-sigCh:
-			log.Printf("Shutting down. Total: %d positions in %d cycles, %d errors.",
-				totalCollected, totalCycles, totalErrors)
+			slog.Info("shutting down", "positions", totalCollected, "cycles", totalCycles, "errors", totalErrors)
+			if err := snapshots.flush(withLog(ctx, "component", "collect")); err != nil {
+				slog.Error("failed to write the last snapshot batch", "error", err)
+			}
 			cancel()
+			runner.shutdown(jobShutdownGrace)
 			return
 		case <-ticker.C:
-			collected, err := collectPositions(ctx, r2, bucket)
+			cycle++
+			cycleStart := time.Now()
+			cycleCtx := withLog(ctx, "component", "collect", "cycle", cycle)
+			collected, err := collectPositions(cycleCtx, src, store, snapshots)
+			observeCollect(collected, err)
 			if err != nil {
 				totalErrors++
-				log.Printf("[collect] Failed: %v", err)
+				logger(cycleCtx).Error("collection failed", "error", err, "duration", time.Since(cycleStart))
 			} else {
 				totalCollected += int64(collected)
 				totalCycles++
+				l := logger(cycleCtx).With("count", collected, "duration", time.Since(cycleStart))
 				if totalCycles%10 == 0 {
-					log.Printf("[collect] cycle %d: %d positions | total: %d, errors: %d",
-						totalCycles, collected, totalCollected, totalErrors)
+					l.Info("collected positions", "totalPositions", totalCollected, "totalErrors", totalErrors)
 				} else {
-					log.Printf("[collect] %d positions", collected)
+					l.Info("collected positions")
 				}
 			}
-			checkScheduledJobs(ctx, jobs, jobLastRun)
+			checkScheduledJobs(ctx, jobs, jobNextRun, runner)
 		}
 	}
 }
 
-func checkScheduledJobs(ctx context.Context, jobs []scheduledJob, lastRun map[string]string) {
-	now := time.Now().UTC()
-	utcHour := now.Hour()
-	utcDay := now.Weekday()
-	todayKey := now.Format("2006-01-02")
-
-	for _, job := range jobs {
-		if utcHour != job.hour {
-			continue
-		}
-		if job.dayOfWeek != nil && utcDay != *job.dayOfWeek {
-			continue
-		}
-		runKey := todayKey + ":" + job.name
-		if lastRun[job.name] == runKey {
-			continue
-		}
-		lastRun[job.name] = runKey
+// envInt reads a positive integer from the environment, or returns def.
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		slog.Warn("invalid integer setting, using default", "name", name, "value", v, "default", def)
+		return def
+	}
+	return n
+}
 
-		log.Printf("[scheduler] Starting %s...", job.name)
-		if err := job.fn(ctx); err != nil {
-			log.Printf("[scheduler] %s failed: %v", job.name, err)
-		} else {
-			log.Printf("[scheduler] %s completed successfully", job.name)
-		}
+// envDuration reads a Go duration (e.g. "25s") from the environment, or returns def.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		slog.Warn("invalid duration setting, using default", "name", name, "value", v, "default", def)
+		return def
 	}
+	return d
 }
 
 func maskDatabaseURL(url string) string {
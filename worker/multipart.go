@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// multipartPartSize is the buffered size of each uploaded part. S3/R2 require
+// at least 5 MiB for every part except the last.
+const multipartPartSize = 8 << 20
+
+// multipartStagingPrefix holds objects while they stream in. Metadata such as
+// row counts is only known once the stream ends, but a multipart upload's
+// metadata is fixed when it is created, so the object is staged first and
+// then copied to its key by a second upload that carries the metadata.
+// Nothing appears at the key without it. Staged objects left by a crash can
+// be removed by a bucket lifecycle rule on this prefix.
+const multipartStagingPrefix = ".uploads/"
+
+// multipartClient is the part of *s3.Client a multipartUpload uses.
+type multipartClient interface {
+	CreateMultipartUpload(ctx context.Context, in *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, in *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	UploadPartCopy(ctx context.Context, in *s3.UploadPartCopyInput, optFns ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error)
+	CompleteMultipartUpload(ctx context.Context, in *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, in *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+	DeleteObject(ctx context.Context, in *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+}
+
+// multipartUpload streams an object to R2 as an S3 multipart upload, holding
+// at most one part in memory. It implements io.Writer; call Complete to
+// finish the object or Abort to discard it. Complete cleans up after itself
+// when it fails, so a later Abort is a no-op.
+type multipartUpload struct {
+	ctx         context.Context
+	r2          multipartClient
+	bucket      string
+	key         string
+	staging     string // key the parts are uploaded to
+	contentType string
+	uploadID    *string // staging upload; nil once completed or aborted
+	buf         bytes.Buffer
+	parts       []types.CompletedPart
+	partSizes   []int64
+	size        int64
+}
+
+func newMultipartUpload(ctx context.Context, r2 multipartClient, bucket, key, contentType string) (*multipartUpload, error) {
+	staging := multipartStagingPrefix + key
+	out, err := r2.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      &bucket,
+		Key:         &staging,
+		ContentType: &contentType,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create multipart upload %s: %w", key, err)
+	}
+	u := &multipartUpload{
+		ctx:         ctx,
+		r2:          r2,
+		bucket:      bucket,
+		key:         key,
+		staging:     staging,
+		contentType: contentType,
+		uploadID:    out.UploadId,
+	}
+	u.buf.Grow(multipartPartSize)
+	return u, nil
+}
+
+func (u *multipartUpload) Write(p []byte) (int, error) {
+	n, _ := u.buf.Write(p)
+	u.size += int64(n)
+	for u.buf.Len() >= multipartPartSize {
+		if err := u.uploadPart(u.buf.Next(multipartPartSize)); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Size is the number of bytes written so far.
+func (u *multipartUpload) Size() int64 { return u.size }
+
+func (u *multipartUpload) uploadPart(data []byte) error {
+	partNumber := int32(len(u.parts) + 1)
+	out, err := u.r2.UploadPart(u.ctx, &s3.UploadPartInput{
+		Bucket:     &u.bucket,
+		Key:        &u.staging,
+		UploadId:   u.uploadID,
+		PartNumber: &partNumber,
+		Body:       bytes.NewReader(data),
+	})
+	if err != nil {
+		return fmt.Errorf("upload part %d of %s: %w", partNumber, u.key, err)
+	}
+	u.parts = append(u.parts, types.CompletedPart{ETag: out.ETag, PartNumber: &partNumber})
+	u.partSizes = append(u.partSizes, int64(len(data)))
+	return nil
+}
+
+// Complete uploads the final part, assembles the staged object and copies it
+// to its key part by part, with metadata set when that copy is created. The
+// staged object is deleted either way.
+func (u *multipartUpload) Complete(metadata map[string]string) error {
+	if u.uploadID == nil {
+		return fmt.Errorf("upload of %s already finished", u.key)
+	}
+	if u.buf.Len() > 0 || len(u.parts) == 0 {
+		if err := u.uploadPart(u.buf.Bytes()); err != nil {
+			u.Abort()
+			return err
+		}
+		u.buf.Reset()
+	}
+
+	if _, err := u.r2.CompleteMultipartUpload(u.ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          &u.bucket,
+		Key:             &u.staging,
+		UploadId:        u.uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: u.parts},
+	}); err != nil {
+		u.Abort()
+		return fmt.Errorf("complete multipart upload %s: %w", u.key, err)
+	}
+	u.uploadID = nil
+	defer u.deleteStaged()
+
+	out, err := u.r2.CreateMultipartUpload(u.ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      &u.bucket,
+		Key:         &u.key,
+		ContentType: &u.contentType,
+		Metadata:    metadata,
+	})
+	if err != nil {
+		return fmt.Errorf("create multipart upload %s: %w", u.key, err)
+	}
+	source := (&url.URL{Path: u.bucket + "/" + u.staging}).EscapedPath()
+	parts := make([]types.CompletedPart, len(u.parts))
+	var offset int64
+	for i, size := range u.partSizes {
+		partNumber := int32(i + 1)
+		input := &s3.UploadPartCopyInput{
+			Bucket:     &u.bucket,
+			Key:        &u.key,
+			UploadId:   out.UploadId,
+			PartNumber: &partNumber,
+			CopySource: &source,
+		}
+		if len(u.partSizes) > 1 {
+			input.CopySourceRange = aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+size-1))
+		}
+		copied, err := u.r2.UploadPartCopy(u.ctx, input)
+		if err != nil {
+			u.abort(u.key, out.UploadId)
+			return fmt.Errorf("copy part %d of %s: %w", partNumber, u.key, err)
+		}
+		parts[i] = types.CompletedPart{ETag: copied.CopyPartResult.ETag, PartNumber: &partNumber}
+		offset += size
+	}
+	if _, err := u.r2.CompleteMultipartUpload(u.ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          &u.bucket,
+		Key:             &u.key,
+		UploadId:        out.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	}); err != nil {
+		u.abort(u.key, out.UploadId)
+		return fmt.Errorf("complete multipart upload %s: %w", u.key, err)
+	}
+	return nil
+}
+
+// Abort discards the upload and any parts already sent. It does nothing once
+// Complete has been called, which cleans up on its own.
+func (u *multipartUpload) Abort() {
+	if u.uploadID == nil {
+		return
+	}
+	u.abort(u.staging, u.uploadID)
+	u.uploadID = nil
+}
+
+// abort discards upload id of key. It uses a fresh context so cleanup still
+// happens when the job's context was canceled.
+func (u *multipartUpload) abort(key string, id *string) {
+	if _, err := u.r2.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+		Bucket:   &u.bucket,
+		Key:      &key,
+		UploadId: id,
+	}); err != nil {
+		logger(u.ctx).Warn("could not abort multipart upload", "key", key, "error", err)
+	}
+}
+
+// deleteStaged removes the assembled staging object.
+func (u *multipartUpload) deleteStaged() {
+	if _, err := u.r2.DeleteObject(context.Background(), &s3.DeleteObjectInput{Bucket: &u.bucket, Key: &u.staging}); err != nil {
+		logger(u.ctx).Warn("could not delete staged upload", "key", u.staging, "error", err)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// fakeMultipart is an in-memory multipartClient that records open uploads
+// and stored objects, and fails the calls named in failOn.
+type fakeMultipart struct {
+	failOn  map[string]bool
+	uploads map[string]string // upload id -> key
+	objects map[string]map[string]string
+	nextID  int
+}
+
+func newFakeMultipart(failOn ...string) *fakeMultipart {
+	f := &fakeMultipart{failOn: map[string]bool{}, uploads: map[string]string{}, objects: map[string]map[string]string{}}
+	for _, op := range failOn {
+		f.failOn[op] = true
+	}
+	return f
+}
+
+func (f *fakeMultipart) fail(op, key string) error {
+	if f.failOn[op] || f.failOn[op+" "+key] {
+		return fmt.Errorf("%s %s: injected failure", op, key)
+	}
+	return nil
+}
+
+func (f *fakeMultipart) CreateMultipartUpload(ctx context.Context, in *s3.CreateMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	if err := f.fail("CreateMultipartUpload", *in.Key); err != nil {
+		return nil, err
+	}
+	f.nextID++
+	id := fmt.Sprint(f.nextID)
+	f.uploads[id] = *in.Key
+	return &s3.CreateMultipartUploadOutput{UploadId: &id}, nil
+}
+
+func (f *fakeMultipart) UploadPart(ctx context.Context, in *s3.UploadPartInput, _ ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	return &s3.UploadPartOutput{ETag: aws.String("etag")}, f.fail("UploadPart", *in.Key)
+}
+
+func (f *fakeMultipart) UploadPartCopy(ctx context.Context, in *s3.UploadPartCopyInput, _ ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error) {
+	if err := f.fail("UploadPartCopy", *in.Key); err != nil {
+		return nil, err
+	}
+	return &s3.UploadPartCopyOutput{CopyPartResult: &types.CopyPartResult{ETag: aws.String("etag")}}, nil
+}
+
+func (f *fakeMultipart) CompleteMultipartUpload(ctx context.Context, in *s3.CompleteMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	if err := f.fail("CompleteMultipartUpload", *in.Key); err != nil {
+		return nil, err
+	}
+	if f.uploads[*in.UploadId] != *in.Key {
+		return nil, errors.New("no such upload")
+	}
+	delete(f.uploads, *in.UploadId)
+	f.objects[*in.Key] = map[string]string{}
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (f *fakeMultipart) AbortMultipartUpload(ctx context.Context, in *s3.AbortMultipartUploadInput, _ ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	if f.uploads[*in.UploadId] != *in.Key {
+		return nil, errors.New("no such upload")
+	}
+	delete(f.uploads, *in.UploadId)
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (f *fakeMultipart) DeleteObject(ctx context.Context, in *s3.DeleteObjectInput, _ ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	delete(f.objects, *in.Key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func TestMultipartUploadCleansUpOnFailure(t *testing.T) {
+	const key = "positions/2025/01/30.parquet"
+	for _, failOn := range []string{
+		"UploadPart",
+		"CompleteMultipartUpload " + multipartStagingPrefix + key,
+		"CreateMultipartUpload " + key,
+		"UploadPartCopy",
+		"CompleteMultipartUpload " + key,
+		"", // success
+	} {
+		t.Run(failOn, func(t *testing.T) {
+			r2 := newFakeMultipart(failOn)
+			u, err := newMultipartUpload(context.Background(), r2, "bucket", key, "application/vnd.apache.parquet")
+			if err != nil {
+				t.Fatal(err)
+			}
+			u.Write([]byte("PAR1"))
+			err = u.Complete(map[string]string{"rows": "1"})
+			if (err == nil) != (failOn == "") {
+				t.Fatalf("Complete = %v", err)
+			}
+			// What archiveWriter does after a failed Complete.
+			u.Abort()
+
+			if len(r2.uploads) != 0 {
+				t.Errorf("uploads left open: %v", r2.uploads)
+			}
+			if _, ok := r2.objects[multipartStagingPrefix+key]; ok {
+				t.Error("staged object left behind")
+			}
+			if _, ok := r2.objects[key]; ok != (failOn == "") {
+				t.Errorf("object at key: %v, want %v", ok, failOn == "")
+			}
+		})
+	}
+}
+
+func TestArchiveWriterCloseFailure(t *testing.T) {
+	ctx := context.Background()
+	store := newTestLocalStore(t)
+	const key = "positions/2025/01/30.parquet"
+	aw, err := newArchiveWriter(ctx, store, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := aw.WriteRowGroup([]ParquetPosition{{RecordedAt: time.Now(), VehicleID: "a"}}); err != nil {
+		t.Fatal(err)
+	}
+	// A directory in the way makes the final rename fail.
+	if err := os.MkdirAll(filepath.Join(store.dir, "positions", "2025", "01", "30.parquet", "x"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := aw.Close(map[string]string{}); err == nil {
+		t.Fatal("Close succeeded")
+	}
+	entries, _ := os.ReadDir(filepath.Join(store.dir, "positions", "2025", "01"))
+	if len(entries) != 1 {
+		t.Errorf("failed Close left %d entries, want only the directory", len(entries))
+	}
+	if _, err := os.Stat(store.metaPath(key)); err == nil {
+		t.Error("failed Close left metadata behind")
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// defaultHTTPAddr is where /metrics and the health checks are served unless
+// HTTP_ADDR overrides it (fly.toml's [metrics] and [checks] use this port).
+const defaultHTTPAddr = ":9091"
+
+var (
+	feedFetchSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "portomove_feed_fetch_duration_seconds",
+		Help:    "Feed HTTP request latency, by source and status (HTTP code, or \"error\").",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 25},
+	}, []string{"source", "status"})
+
+	feedEntities = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "portomove_feed_entities_total",
+		Help: "Feed entities by parse result (parsed, or dropped for lacking an ID or location).",
+	}, []string{"source", "result"})
+
+	r2PutSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "portomove_r2_put_duration_seconds",
+		Help:    "Object store (R2) put latency, by object (snapshot, today, gtfsrt, spool).",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"object"})
+
+	r2PutFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "portomove_r2_put_failures_total",
+		Help: "Failed object store puts, by object.",
+	}, []string{"object"})
+
+	collectCycles = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "portomove_collect_cycles_total",
+		Help: "Collection cycles, by result (ok, error).",
+	}, []string{"result"})
+
+	positionsCollected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "portomove_positions_collected_total",
+		Help: "Positions written to snapshots.",
+	})
+
+	positionsFiltered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "portomove_positions_filtered_total",
+		Help: "Positions caught by the stale or duplicate filters, by reason.",
+	}, []string{"reason"})
+
+	lastCollectSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "portomove_collect_last_success_timestamp_seconds",
+		Help: "Unix time of the last successful collection cycle; alert when it stops advancing.",
+	})
+
+	activeVehicles = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "portomove_active_vehicles",
+		Help: "Vehicles with a current (non-stale) position in the last cycle.",
+	})
+
+	spoolFiles = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "portomove_spool_files",
+		Help: "Snapshots waiting in the local spool for the store to accept them.",
+	})
+
+	spoolBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "portomove_spool_bytes",
+		Help: "Size of the snapshots waiting in the local spool.",
+	})
+
+	spoolUploaded = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "portomove_spool_uploaded_total",
+		Help: "Spooled snapshots uploaded after a failed write.",
+	})
+
+	spoolDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "portomove_spool_dropped_total",
+		Help: "Spooled snapshots dropped, oldest first, because the spool was full.",
+	})
+
+	jobSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "portomove_job_duration_seconds",
+		Help:    "Scheduled job run time, by job and status (succeeded, failed, skipped).",
+		Buckets: []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200, 2400, 3600},
+	}, []string{"job", "status"})
+
+	jobLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "portomove_job_last_success_timestamp_seconds",
+		Help: "Unix time the job last succeeded.",
+	}, []string{"job"})
+)
+
+// observeFetch records a feed request started at start. resp is nil if the
+// request failed.
+func observeFetch(source string, start time.Time, resp *http.Response) {
+	status := "error"
+	if resp != nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	feedFetchSeconds.WithLabelValues(source, status).Observe(time.Since(start).Seconds())
+}
+
+// observeR2Put records a PutObject of object started at start.
+func observeR2Put(object string, start time.Time, err error) {
+	r2PutSeconds.WithLabelValues(object).Observe(time.Since(start).Seconds())
+	if err != nil {
+		r2PutFailures.WithLabelValues(object).Inc()
+	} else if health != nil {
+		health.r2Written()
+	}
+}
+
+// observeCollect records the outcome of one collection cycle.
+func observeCollect(collected int, err error) {
+	if health != nil {
+		health.cycleDone(err)
+	}
+	if err != nil {
+		collectCycles.WithLabelValues("error").Inc()
+		return
+	}
+	collectCycles.WithLabelValues("ok").Inc()
+	positionsCollected.Add(float64(collected))
+	lastCollectSuccess.SetToCurrentTime()
+}
+
+// startHTTPServer serves /metrics, /healthz and /readyz on HTTP_ADDR in the
+// background. The caller shuts the returned server down on exit.
+func startHTTPServer(h *workerHealth) *http.Server {
+	addr := os.Getenv("HTTP_ADDR")
+	if addr == "" {
+		addr = defaultHTTPAddr
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", h.handleHealthz)
+	mux.HandleFunc("/readyz", h.handleReadyz)
+
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP server stopped", "addr", addr, "error", err)
+		}
+	}()
+	slog.Info("serving /metrics, /healthz, /readyz", "addr", addr, "readyWindow", h.window)
+	return srv
+}
+
+// stopHTTPServer shuts srv down, giving in-flight scrapes a moment to finish.
+func stopHTTPServer(srv *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+}
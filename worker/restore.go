@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// restoreBatch is about how many of today's snapshot cycles are fetched
+	// concurrently and held in memory at once while replaying them: 32
+	// per-cycle files, or as many .ndjson batches as hold that many cycles
+	// (always at least one).
+	restoreBatch = 32
+	// defaultRestoreTimeout bounds the replay unless RESTORE_TIMEOUT
+	// overrides it; collection starts afterwards either way.
+	defaultRestoreTimeout = 2 * time.Minute
+)
+
+// restoreRollingState rebuilds today's rollingState (and the dedup cache) by
+// replaying today's snapshots from the store, so a restart does not reset
+// today.json to zero mid-day. Duplicates dropped under
+// DUPLICATE_POSITIONS=drop were never written and are not recounted.
+func restoreRollingState(ctx context.Context, store objectStore) error {
+	ctx, cancel := context.WithTimeout(ctx, envDuration("RESTORE_TIMEOUT", defaultRestoreTimeout))
+	defer cancel()
+	start := time.Now()
+
+	today := time.Now().UTC().Format("2006-01-02")
+	keys, err := listSnapshotKeys(ctx, store, today)
+	if err != nil {
+		return fmt.Errorf("list today's snapshots: %w", err)
+	}
+	if len(keys) == 0 {
+		logger(ctx).Info("no snapshots today, starting from zero", "date", today)
+		return nil
+	}
+
+	replayed, read := 0, 0
+	var last *SnapshotFile
+	for _, batch := range restoreBatches(keys) {
+		files := make([][]*SnapshotFile, len(batch))
+		g, gctx := errgroup.WithContext(ctx)
+		for i, key := range batch {
+			g.Go(func() error {
+				snaps, err := readSnapshots(gctx, store, key)
+				if err != nil {
+					// One unreadable file should not block the rest.
+					logger(ctx).Warn("skipping snapshot in restore", "key", key, "error", err)
+					return gctx.Err()
+				}
+				files[i] = snaps
+				return nil
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return fmt.Errorf("replay stopped after %d of %d snapshot files: %w", read, len(keys), err)
+		}
+		read += len(batch)
+
+		// Snapshot keys sort by time, so ingest in order.
+		for _, snaps := range files {
+			for _, snap := range snaps {
+				recordedAt, err := time.Parse(time.RFC3339, snap.RecordedAt)
+				if err != nil {
+					continue
+				}
+				rows, duplicates := snap.rows()
+				state.ingest(rows, duplicates, recordedAt)
+				replayed++
+				last = snap
+			}
+		}
+	}
+
+	if last != nil {
+		dedup.seed(last)
+	}
+	summary := state.summary(time.Now())
+	logger(ctx).Info("rolling state restored", "date", today, "snapshots", replayed,
+		"positions", summary.PositionsCollected, "vehicles", summary.ActiveVehicles,
+		"duration", time.Since(start))
+	return nil
+}
+
+// restoreBatches splits today's snapshot keys into the batches restore
+// fetches together: about restoreBatch cycles each, by snapshotCycles, and
+// at least one object.
+func restoreBatches(keys []string) [][]string {
+	var batches [][]string
+	for batchStart, batchEnd := 0, 0; batchStart < len(keys); batchStart = batchEnd {
+		for cycles := 0; batchEnd < len(keys); batchEnd++ {
+			cycles += snapshotCycles(keys[batchEnd])
+			if cycles > restoreBatch && batchEnd > batchStart {
+				break
+			}
+		}
+		batches = append(batches, keys[batchStart:batchEnd])
+	}
+	return batches
+}
+
+// rows converts a snapshot back into the rows it was written from, plus how
+// many were flagged as duplicates.
+func (f *SnapshotFile) rows() ([]*positionRow, int) {
+	rows := make([]*positionRow, 0, len(f.Positions))
+	duplicates := 0
+	for i := range f.Positions {
+		if f.Positions[i].Duplicate {
+			duplicates++
+		}
+		rows = append(rows, snapshotPositionToRow(&f.Positions[i]))
+	}
+	return rows, duplicates
+}
+
+// seed fills the cache from the last snapshot written before a restart, so
+// the first cycle afterwards still recognises unchanged positions.
+func (c *dedupCache) seed(f *SnapshotFile) {
+	recordedAt, err := time.Parse(time.RFC3339, f.RecordedAt)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range f.Positions {
+		p := &f.Positions[i]
+		var observedAt time.Time
+		if p.ObservedAt != "" {
+			observedAt, _ = time.Parse(time.RFC3339, p.ObservedAt)
+		}
+		c.last[p.VehicleID] = lastPosition{lat: p.Lat, lon: p.Lon, observedAt: observedAt, seenAt: recordedAt}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDedupSeedMatchesSubSecondTimes(t *testing.T) {
+	now := time.Date(2025, 1, 31, 12, 0, 30, 0, time.UTC)
+	observedAt := time.Date(2025, 1, 31, 12, 0, 5, 250_000_000, time.UTC)
+	row := func() *positionRow {
+		at := observedAt
+		return &positionRow{vehicleID: "3245", lat: 41.149, lon: -8.611, observedAt: &at}
+	}
+
+	// The last snapshot before a restart, as the collector writes it.
+	snap := &SnapshotFile{
+		RecordedAt: now.Format(time.RFC3339),
+		Positions:  []SnapshotPosition{newSnapshotPosition(row())},
+	}
+	c := &dedupCache{mode: "flag", last: make(map[string]lastPosition)}
+	c.seed(snap)
+
+	rows, duplicates := c.apply([]*positionRow{row()}, now.Add(30*time.Second))
+	if duplicates != 1 || !rows[0].duplicate {
+		t.Errorf("unchanged position after restart: %d duplicates, want 1", duplicates)
+	}
+
+	moved := row()
+	later := observedAt.Add(500 * time.Millisecond)
+	moved.observedAt = &later
+	if _, duplicates := c.apply([]*positionRow{moved}, now.Add(time.Minute)); duplicates != 0 {
+		t.Errorf("newer observation flagged as duplicate")
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultJobTimeout bounds a job run whose scheduledJob has no timeout.
+	defaultJobTimeout = time.Hour
+	// jobShutdownGrace is how long shutdown waits for cancelled jobs to
+	// record their outcome (fly.toml kill_timeout must be longer).
+	jobShutdownGrace = 20 * time.Second
+)
+
+// jobRunner runs scheduled jobs on their own goroutines so the collection
+// loop never blocks on them. At most one run of each job is in flight, a job
+// waits for in-flight runs of the jobs it depends on and is skipped if one it
+// requires has not succeeded for the same target date, and at most
+// JOB_CONCURRENCY jobs (default 1, to stay within the VM's memory) execute
+// at once.
+type jobRunner struct {
+	store *jobRunStore
+	slots chan struct{}
+	wg    sync.WaitGroup
+
+	mu      sync.Mutex
+	running map[string]chan struct{} // closed when the job's run ends
+}
+
+func newJobRunner(store *jobRunStore) *jobRunner {
+	return &jobRunner{
+		store:   store,
+		slots:   make(chan struct{}, envInt("JOB_CONCURRENCY", 1)),
+		running: make(map[string]chan struct{}),
+	}
+}
+
+// start runs job for t on a new goroutine. It returns false, without running
+// anything, if a run of the job is already in flight.
+func (r *jobRunner) start(ctx context.Context, job *scheduledJob, t jobTarget, date time.Time) bool {
+	done, ok := r.acquire(job.name)
+	if !ok {
+		return false
+	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer r.release(job.name, done)
+		r.execute(ctx, job, t, date)
+	}()
+	return true
+}
+
+// run is start without the goroutine: it blocks until the run ends and
+// returns its error. A job already in flight is waited for first.
+func (r *jobRunner) run(ctx context.Context, job *scheduledJob, t jobTarget, date time.Time) error {
+	for {
+		done, ok := r.acquire(job.name)
+		if ok {
+			defer r.release(job.name, done)
+			return r.execute(ctx, job, t, date)
+		}
+		if err := r.wait(ctx, job.name); err != nil {
+			return err
+		}
+	}
+}
+
+// goRun runs fn on a goroutine that shutdown waits for.
+func (r *jobRunner) goRun(fn func()) {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		fn()
+	}()
+}
+
+func (r *jobRunner) acquire(name string) (chan struct{}, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, busy := r.running[name]; busy {
+		return nil, false
+	}
+	done := make(chan struct{})
+	r.running[name] = done
+	return done, true
+}
+
+func (r *jobRunner) release(name string, done chan struct{}) {
+	r.mu.Lock()
+	delete(r.running, name)
+	r.mu.Unlock()
+	close(done)
+}
+
+// wait blocks until the in-flight run of job name (if any) ends.
+func (r *jobRunner) wait(ctx context.Context, name string) error {
+	r.mu.Lock()
+	done := r.running[name]
+	r.mu.Unlock()
+	if done == nil {
+		return nil
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *jobRunner) execute(ctx context.Context, job *scheduledJob, t jobTarget, date time.Time) error {
+	for _, dep := range job.dependencies() {
+		r.mu.Lock()
+		busy := r.running[dep] != nil
+		r.mu.Unlock()
+		if busy {
+			logger(ctx).Info("waiting for dependency to finish", "job", job.name, "dependency", dep)
+		}
+		if err := r.wait(ctx, dep); err != nil {
+			return err
+		}
+	}
+
+	select {
+	case r.slots <- struct{}{}:
+		defer func() { <-r.slots }()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	timeout := job.timeout
+	if timeout == 0 {
+		timeout = defaultJobTimeout
+	}
+	jobCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return runJob(jobCtx, r.store, job, t, date, true)
+}
+
+// shutdown waits up to grace for running jobs, which should already have
+// been cancelled through their context, to return.
+func (r *jobRunner) shutdown(grace time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(grace):
+		r.mu.Lock()
+		var names []string
+		for name := range r.running {
+			names = append(names, name)
+		}
+		r.mu.Unlock()
+		slog.Warn("jobs still running after shutdown grace", "grace", grace, "jobs", names)
+	}
+}
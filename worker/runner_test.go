@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testTarget = jobTarget{date: "2025-01-30", hour: noHour}
+
+func TestJobRunnerSkipsJobInFlight(t *testing.T) {
+	ctx := context.Background()
+	r := newJobRunner(&jobRunStore{})
+	release := make(chan struct{})
+	var runs atomic.Int32
+	job := &scheduledJob{name: "archive-positions", fn: func(ctx context.Context, _ time.Time) error {
+		runs.Add(1)
+		<-release
+		return nil
+	}}
+
+	if !r.start(ctx, job, testTarget, time.Time{}) {
+		t.Fatal("first start did not run the job")
+	}
+	if r.start(ctx, job, testTarget, time.Time{}) {
+		t.Error("second start ran while the first was in flight")
+	}
+	close(release)
+	r.shutdown(time.Second)
+	if n := runs.Load(); n != 1 {
+		t.Errorf("job ran %d times, want 1", n)
+	}
+	if !r.start(ctx, job, testTarget, time.Time{}) {
+		t.Error("start after the run ended did not run the job")
+	}
+	r.shutdown(time.Second)
+}
+
+func TestJobRunnerTimeout(t *testing.T) {
+	r := newJobRunner(&jobRunStore{})
+	job := &scheduledJob{name: "aggregate-daily", timeout: 10 * time.Millisecond, fn: func(ctx context.Context, _ time.Time) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			return errors.New("context not cancelled")
+		}
+	}}
+	if err := r.run(context.Background(), job, testTarget, time.Time{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("run = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestJobRunnerConcurrency(t *testing.T) {
+	t.Setenv("JOB_CONCURRENCY", "2")
+	ctx := context.Background()
+	r := newJobRunner(&jobRunStore{})
+	release := make(chan struct{})
+	entered := make(chan struct{}, 3)
+	fn := func(ctx context.Context, _ time.Time) error {
+		entered <- struct{}{}
+		<-release
+		return nil
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if !r.start(ctx, &scheduledJob{name: name, fn: fn}, testTarget, time.Time{}) {
+			t.Fatalf("start %s did not run the job", name)
+		}
+	}
+	for range 2 {
+		<-entered
+	}
+	select {
+	case <-entered:
+		t.Error("a third job started beyond JOB_CONCURRENCY")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-entered // the third job, once a slot frees up
+	r.shutdown(time.Second)
+}
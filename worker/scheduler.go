@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/robfig/cron/v3"
+)
+
+// defaultCatchUpDays is how far back startup catch-up looks for missed runs
+// unless CATCHUP_DAYS overrides it (0 disables catch-up).
+const defaultCatchUpDays = 3
+
+// defaultScheduleTZ is the timezone job cron expressions are evaluated in
+// unless SCHEDULE_TZ overrides it: Porto's, so jobs tied to the service day
+// keep their local time across DST changes.
+const defaultScheduleTZ = "Europe/Lisbon"
+
+// scheduleLocation is the timezone of job schedules and of daily run targets.
+var scheduleLocation = time.UTC
+
+// noHour marks a jobTarget of a daily (or weekly) job.
+const noHour = -1
+
+// jobTarget is what one execution of a job covers: a date, plus a UTC hour
+// for hourly jobs.
+type jobTarget struct {
+	date string // YYYY-MM-DD
+	hour int    // 0-23, or noHour
+}
+
+func (t jobTarget) String() string {
+	if t.hour == noHour {
+		return t.date
+	}
+	return fmt.Sprintf("%s %02d:00", t.date, t.hour)
+}
+
+// target returns what a run of j fired at firedAt covers: the previous UTC
+// hour for hourly jobs, otherwise the firing date (in scheduleLocation)
+// shifted by targetOffset days.
+func (j *scheduledJob) target(firedAt time.Time) jobTarget {
+	if j.hourly {
+		h := firedAt.UTC().Truncate(time.Hour).Add(-time.Hour)
+		return jobTarget{date: h.Format("2006-01-02"), hour: h.Hour()}
+	}
+	return jobTarget{date: firedAt.In(scheduleLocation).AddDate(0, 0, j.targetOffset).Format("2006-01-02"), hour: noHour}
+}
+
+// configureSchedules sets scheduleLocation from SCHEDULE_TZ and parses each
+// job's cron expression, replacing it with SCHEDULE_<NAME> (e.g.
+// SCHEDULE_AGGREGATE_DAILY="30 3 * * *") when set. A spec of "off" leaves the
+// job unscheduled; it can still be run from the CLI.
+func configureSchedules(jobs []scheduledJob) error {
+	tz := os.Getenv("SCHEDULE_TZ")
+	if tz == "" {
+		tz = defaultScheduleTZ
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return fmt.Errorf("invalid SCHEDULE_TZ=%q: %w", tz, err)
+	}
+	scheduleLocation = loc
+
+	for i := range jobs {
+		job := &jobs[i]
+		envName := "SCHEDULE_" + strings.ToUpper(strings.ReplaceAll(job.name, "-", "_"))
+		if spec := os.Getenv(envName); spec != "" {
+			job.spec = spec
+		}
+		if job.spec == "off" {
+			job.schedule = nil
+			continue
+		}
+		sched, err := cron.ParseStandard("CRON_TZ=" + tz + " " + job.spec)
+		if err != nil {
+			return fmt.Errorf("invalid schedule for %s %q: %w", job.name, job.spec, err)
+		}
+		job.schedule = sched
+	}
+	return nil
+}
+
+// jobRunDB is the part of *pgxpool.Pool a jobRunStore uses.
+type jobRunDB interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+// jobRunStore persists job executions in "WorkerJobRun". Without a database
+// (or if the table is missing) it records nothing and reports nothing as
+// done, which degrades to the old in-memory behaviour.
+type jobRunStore struct {
+	db jobRunDB
+}
+
+// newJobRunStore returns a jobRunStore on pool, which may be nil.
+func newJobRunStore(pool *pgxpool.Pool) *jobRunStore {
+	if pool == nil {
+		return &jobRunStore{}
+	}
+	return &jobRunStore{db: pool}
+}
+
+// start records a running execution and returns its id, or 0 if it could not
+// be recorded.
+func (s *jobRunStore) start(ctx context.Context, job string, t jobTarget) int64 {
+	if s.db == nil {
+		return 0
+	}
+	var hour *int
+	if t.hour != noHour {
+		hour = &t.hour
+	}
+	var id int64
+	err := s.db.QueryRow(ctx, `
+		INSERT INTO "WorkerJobRun" (job, "targetDate", "targetHour", status, "startedAt")
+		VALUES ($1, $2::date, $3, 'running', $4)
+		RETURNING id
+	`, job, t.date, hour, time.Now().UTC()).Scan(&id)
+	if err != nil {
+		logger(ctx).Warn("could not record job run", "job", job, "error", err)
+		return 0
+	}
+	return id
+}
+
+// finish marks execution id as succeeded, or failed (skipped, for an
+// upstreamError) with runErr.
+func (s *jobRunStore) finish(ctx context.Context, id int64, runErr error) {
+	if s.db == nil || id == 0 {
+		return
+	}
+	status := "succeeded"
+	var errMsg *string
+	if runErr != nil {
+		status = "failed"
+		var upstream *upstreamError
+		if errors.As(runErr, &upstream) {
+			status = "skipped"
+		}
+		msg := runErr.Error()
+		errMsg = &msg
+	}
+	// Record the outcome even if ctx was cancelled mid-job.
+	_, err := s.db.Exec(context.Background(), `
+		UPDATE "WorkerJobRun" SET status = $2, "finishedAt" = $3, error = $4 WHERE id = $1
+	`, id, status, time.Now().UTC(), errMsg)
+	if err != nil {
+		logger(ctx).Warn("could not record job run outcome", "runId", id, "error", err)
+	}
+}
+
+// succeeded returns the targets of job that have a successful run on or
+// after since (YYYY-MM-DD).
+func (s *jobRunStore) succeeded(ctx context.Context, job, since string) (map[jobTarget]bool, error) {
+	done := make(map[jobTarget]bool)
+	if s.db == nil {
+		return done, nil
+	}
+	rows, err := s.db.Query(ctx, `
+		SELECT to_char("targetDate", 'YYYY-MM-DD'), COALESCE("targetHour", -1)
+		FROM "WorkerJobRun"
+		WHERE job = $1 AND status = 'succeeded' AND "targetDate" >= $2::date
+	`, job, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t jobTarget
+		var hour int16
+		if err := rows.Scan(&t.date, &hour); err != nil {
+			return nil, err
+		}
+		t.hour = int(hour)
+		done[t] = true
+	}
+	return done, rows.Err()
+}
+
+// runJob executes job for target and records the outcome. date is passed to
+// the job function (zero = the job's default day). With checkDeps, a job whose
+// requirements have not succeeded for t is recorded as skipped instead.
+func runJob(ctx context.Context, store *jobRunStore, job *scheduledJob, t jobTarget, date time.Time, checkDeps bool) error {
+	ctx = withLog(ctx, "job", job.name, "target", t.String())
+	log := logger(ctx)
+	if checkDeps {
+		if err := store.checkRequires(ctx, job, t); err != nil {
+			log.Warn("job skipped", "status", "skipped", "error", err)
+			jobSeconds.WithLabelValues(job.name, "skipped").Observe(0)
+			store.finish(ctx, store.start(ctx, job.name, t), err)
+			return err
+		}
+	}
+	log.Info("job starting")
+	start := time.Now()
+	id := store.start(ctx, job.name, t)
+	err := job.fn(ctx, date)
+	store.finish(ctx, id, err)
+	elapsed := time.Since(start)
+	if err != nil {
+		jobSeconds.WithLabelValues(job.name, "failed").Observe(elapsed.Seconds())
+		log.Error("job failed", "status", "failed", "duration", elapsed, "error", err)
+	} else {
+		jobSeconds.WithLabelValues(job.name, "succeeded").Observe(elapsed.Seconds())
+		jobLastSuccess.WithLabelValues(job.name).SetToCurrentTime()
+		log.Info("job succeeded", "status", "succeeded", "duration", elapsed)
+	}
+	return err
+}
+
+// checkScheduledJobs starts the jobs whose next firing time has passed on
+// runner. next holds each job's next firing; the first call only fills it in,
+// since firings before startup are left to catchUpJobs. A job still running
+// from an earlier firing is retried on the next tick.
+func checkScheduledJobs(ctx context.Context, jobs []scheduledJob, next map[string]time.Time, runner *jobRunner) {
+	now := time.Now()
+
+	for i := range jobs {
+		job := &jobs[i]
+		if job.schedule == nil {
+			continue
+		}
+		due, ok := next[job.name]
+		if !ok {
+			next[job.name] = job.schedule.Next(now)
+			continue
+		}
+		if now.Before(due) {
+			continue
+		}
+		if upstreamDue(job, next, now) {
+			continue
+		}
+
+		t := job.target(due)
+		done, err := runner.store.succeeded(ctx, job.name, t.date)
+		if err != nil {
+			logger(ctx).Warn("could not read job runs", "job", job.name, "error", err)
+		}
+		if done[t] {
+			logger(ctx).Info("job already done, skipping", "job", job.name, "target", t.String())
+			next[job.name] = job.schedule.Next(now)
+			continue
+		}
+		if runner.start(ctx, job, t, job.targetDate(t)) {
+			next[job.name] = job.schedule.Next(now)
+		}
+	}
+}
+
+// upstreamDue reports whether a job that job requires is due but not yet
+// started, so job should wait for a later tick rather than be skipped.
+func upstreamDue(job *scheduledJob, next map[string]time.Time, now time.Time) bool {
+	for _, req := range job.requires {
+		if due, ok := next[req]; ok && !now.Before(due) {
+			return true
+		}
+	}
+	return false
+}
+
+// targetDate is the date passed to job's fn for a run covering t: t's date
+// for daily dated jobs and the start of t's UTC hour for hourly ones, so each
+// run processes exactly its target even when it starts late, and zero (the
+// job's default) otherwise.
+func (j *scheduledJob) targetDate(t jobTarget) time.Time {
+	if !j.dated {
+		return time.Time{}
+	}
+	d, _ := time.Parse("2006-01-02", t.date)
+	if j.hourly && t.hour != noHour {
+		return d.Add(time.Duration(t.hour) * time.Hour)
+	}
+	return d
+}
+
+// targetsOn returns the targets a manual run of j for day covers: the day
+// itself, or each of its completed UTC hours for hourly jobs.
+func (j *scheduledJob) targetsOn(day time.Time) []jobTarget {
+	date := day.Format("2006-01-02")
+	if !j.hourly {
+		return []jobTarget{{date: date, hour: noHour}}
+	}
+	lastHour := time.Now().UTC().Truncate(time.Hour).Add(-time.Hour)
+	var targets []jobTarget
+	for h := 0; h < 24; h++ {
+		start := time.Date(day.Year(), day.Month(), day.Day(), h, 0, 0, 0, time.UTC)
+		if start.After(lastHour) {
+			break
+		}
+		targets = append(targets, jobTarget{date: date, hour: h})
+	}
+	return targets
+}
+
+// catchUpDays reads CATCHUP_DAYS; 0 disables catch-up.
+func catchUpDays() int {
+	if os.Getenv("CATCHUP_DAYS") == "0" {
+		return 0
+	}
+	return envInt("CATCHUP_DAYS", defaultCatchUpDays)
+}
+
+// catchUpJobs runs the executions that were due in the last days days but
+// never succeeded, e.g. because the worker was deploying or down at the
+// scheduled time. Runs go through runner one at a time, oldest firing first.
+func catchUpJobs(ctx context.Context, jobs []scheduledJob, runner *jobRunner, days int) {
+	store := runner.store
+	if days <= 0 || store.db == nil {
+		return
+	}
+	now := time.Now()
+	first := now.AddDate(0, 0, -days)
+
+	done := make(map[string]map[jobTarget]bool)
+	for i := range jobs {
+		job := &jobs[i]
+		if job.schedule == nil {
+			continue
+		}
+		var err error
+		done[job.name], err = store.succeeded(ctx, job.name, job.target(first).date)
+		if err != nil {
+			logger(ctx).Warn("catch-up disabled, could not read job runs", "error", err)
+			return
+		}
+	}
+	missed := missedFirings(jobs, done, first, now)
+
+	for _, f := range missed {
+		t := f.job.target(f.at)
+		logger(ctx).Info("catching up missed job", "job", f.job.name, "target", t.String())
+		runner.run(ctx, f.job, t, f.job.targetDate(t))
+		if ctx.Err() != nil {
+			return
+		}
+	}
+	if len(missed) > 0 {
+		logger(ctx).Info("catch-up finished", "jobs", len(missed), "days", days)
+	}
+}
+
+// catchUpFiring is a missed firing of job that catch-up runs.
+type catchUpFiring struct {
+	at  time.Time
+	job *scheduledJob
+}
+
+// missedFirings returns the firings of jobs after first and before now whose
+// target is not in done[job name], oldest first. Daily dated jobs are run
+// once per missed target date, even when a DST change fires them twice in a
+// day; hourly and undated jobs only for their latest missed firing
+// (archive-positions rebuilds hours without a partition from the snapshots).
+func missedFirings(jobs []scheduledJob, done map[string]map[jobTarget]bool, first, now time.Time) []catchUpFiring {
+	var missed []catchUpFiring
+	latest := make(map[string]catchUpFiring)
+	for i := range jobs {
+		job := &jobs[i]
+		if job.schedule == nil {
+			continue
+		}
+		seen := make(map[jobTarget]bool)
+		for at := job.schedule.Next(first); at.Before(now); at = job.schedule.Next(at) {
+			t := job.target(at)
+			if done[job.name][t] {
+				continue
+			}
+			if job.dated && !job.hourly {
+				if !seen[t] {
+					seen[t] = true
+					missed = append(missed, catchUpFiring{at, job})
+				}
+			} else {
+				latest[job.name] = catchUpFiring{at, job}
+			}
+		}
+	}
+	for i := range jobs {
+		if f, ok := latest[jobs[i].name]; ok {
+			missed = append(missed, f)
+		}
+	}
+	sort.SliceStable(missed, func(a, b int) bool { return missed[a].at.Before(missed[b].at) })
+	return missed
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// configureTestSchedules parses jobs' specs in SCHEDULE_TZ=tz, restoring
+// scheduleLocation when the test ends.
+func configureTestSchedules(t *testing.T, tz string, jobs []scheduledJob) {
+	t.Helper()
+	t.Setenv("SCHEDULE_TZ", tz)
+	old := scheduleLocation
+	t.Cleanup(func() { scheduleLocation = old })
+	if err := configureSchedules(jobs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJobTarget(t *testing.T) {
+	configureTestSchedules(t, "Europe/Lisbon", nil)
+	tests := []struct {
+		name     string
+		job      scheduledJob
+		firedAt  time.Time
+		want     jobTarget
+		wantDate time.Time
+	}{
+		{
+			name:     "daily with offset",
+			job:      scheduledJob{dated: true, targetOffset: -1},
+			firedAt:  time.Date(2025, 7, 15, 2, 0, 0, 0, time.UTC), // 03:00 WEST
+			want:     jobTarget{date: "2025-07-14", hour: noHour},
+			wantDate: time.Date(2025, 7, 14, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "daily dates by local day",
+			job:      scheduledJob{dated: true},
+			firedAt:  time.Date(2025, 7, 14, 23, 30, 0, 0, time.UTC), // 00:30 WEST
+			want:     jobTarget{date: "2025-07-15", hour: noHour},
+			wantDate: time.Date(2025, 7, 15, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "hourly covers the previous UTC hour",
+			job:      scheduledJob{dated: true, hourly: true},
+			firedAt:  time.Date(2025, 7, 15, 0, 0, 5, 0, time.UTC),
+			want:     jobTarget{date: "2025-07-14", hour: 23},
+			wantDate: time.Date(2025, 7, 14, 23, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "undated",
+			job:     scheduledJob{},
+			firedAt: time.Date(2025, 7, 14, 4, 0, 0, 0, time.UTC),
+			want:    jobTarget{date: "2025-07-14", hour: noHour},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.job.target(tt.firedAt)
+			if got != tt.want {
+				t.Errorf("target = %v, want %v", got, tt.want)
+			}
+			if d := tt.job.targetDate(got); !d.Equal(tt.wantDate) {
+				t.Errorf("targetDate = %v, want %v", d, tt.wantDate)
+			}
+		})
+	}
+}
+
+func TestTargetsOn(t *testing.T) {
+	day := time.Date(2025, 7, 14, 0, 0, 0, 0, time.UTC)
+	daily := scheduledJob{dated: true}
+	if got := daily.targetsOn(day); !reflect.DeepEqual(got, []jobTarget{{date: "2025-07-14", hour: noHour}}) {
+		t.Errorf("daily targetsOn = %v", got)
+	}
+	hourly := scheduledJob{dated: true, hourly: true}
+	got := hourly.targetsOn(day)
+	if len(got) != 24 || got[0] != (jobTarget{date: "2025-07-14", hour: 0}) || got[23] != (jobTarget{date: "2025-07-14", hour: 23}) {
+		t.Errorf("hourly targetsOn = %v", got)
+	}
+}
+
+func TestMissedFiringsAcrossDST(t *testing.T) {
+	// In Europe/Lisbon clocks go forward at 01:00 UTC on 2025-03-30 and back
+	// at 01:00 UTC on 2025-10-26, when 01:00-02:00 local happens twice.
+	tests := []struct {
+		name       string
+		jobs       []scheduledJob
+		done       map[string]map[jobTarget]bool
+		first, now time.Time
+		want       []string
+	}{
+		{
+			name: "spring forward",
+			jobs: []scheduledJob{
+				{name: "aggregate-daily", spec: "0 3 * * *", dated: true, targetOffset: -1},
+				{name: "archive-hourly", spec: "0 * * * *", hourly: true, dated: true},
+			},
+			first: time.Date(2025, 3, 28, 12, 0, 0, 0, time.UTC),
+			now:   time.Date(2025, 3, 31, 12, 30, 0, 0, time.UTC),
+			want: []string{
+				"03-29 03:00 aggregate-daily 2025-03-28",
+				"03-30 02:00 aggregate-daily 2025-03-29",
+				"03-31 02:00 aggregate-daily 2025-03-30",
+				"03-31 12:00 archive-hourly 2025-03-31 11:00",
+			},
+		},
+		{
+			name: "fall back",
+			jobs: []scheduledJob{
+				{name: "snapshot-schedule", spec: "0 1 * * *", dated: true},
+				{name: "aggregate-daily", spec: "0 3 * * *", dated: true, targetOffset: -1},
+				{name: "refresh-segments", spec: "0 5 * * 1"},
+				{name: "archive-hourly", spec: "0 * * * *", hourly: true, dated: true},
+			},
+			done: map[string]map[jobTarget]bool{
+				"aggregate-daily": {{date: "2025-10-25", hour: noHour}: true},
+			},
+			first: time.Date(2025, 10, 24, 12, 0, 0, 0, time.UTC),
+			now:   time.Date(2025, 10, 27, 12, 30, 0, 0, time.UTC),
+			want: []string{
+				"10-25 00:00 snapshot-schedule 2025-10-25",
+				"10-25 02:00 aggregate-daily 2025-10-24",
+				// 01:00 local fires again at 01:00 UTC; the target runs once.
+				"10-26 00:00 snapshot-schedule 2025-10-26",
+				"10-27 01:00 snapshot-schedule 2025-10-27",
+				"10-27 03:00 aggregate-daily 2025-10-26",
+				"10-27 05:00 refresh-segments 2025-10-27",
+				"10-27 12:00 archive-hourly 2025-10-27 11:00",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configureTestSchedules(t, "Europe/Lisbon", tt.jobs)
+			var got []string
+			for _, f := range missedFirings(tt.jobs, tt.done, tt.first, tt.now) {
+				got = append(got, fmt.Sprintf("%s %s %s", f.at.UTC().Format("01-02 15:04"), f.job.name, f.job.target(f.at)))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("missedFirings =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
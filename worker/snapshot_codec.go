@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Snapshot objects keep their .json (or .ndjson) keys; compression is recorded in
+// Content-Encoding and detected from the body's magic bytes when read, so
+// files written before compression (or with it switched off) still decode.
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// snapshotCompression is the Content-Encoding new snapshots are written
+// with: SNAPSHOT_COMPRESSION=gzip (default), zstd or none.
+var snapshotCompression = "gzip"
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+// zstdCodecs returns a shared encoder and decoder; their EncodeAll and
+// DecodeAll are safe for concurrent use.
+func zstdCodecs() (*zstd.Encoder, *zstd.Decoder) {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+		zstdDecoder, _ = zstd.NewReader(nil)
+	})
+	return zstdEncoder, zstdDecoder
+}
+
+// encodeSnapshot compresses a marshalled snapshot with snapshotCompression
+// and returns the body with its Content-Encoding ("" if uncompressed).
+func encodeSnapshot(body []byte) ([]byte, string, error) {
+	switch snapshotCompression {
+	case "gzip":
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(body); err != nil {
+			return nil, "", err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), "gzip", nil
+	case "zstd":
+		enc, _ := zstdCodecs()
+		return enc.EncodeAll(body, nil), "zstd", nil
+	default:
+		return body, "", nil
+	}
+}
+
+// decodeSnapshotBody returns the JSON of a snapshot object body, whichever
+// encoding it was written with.
+func decodeSnapshotBody(body []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(body, gzipMagic):
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return io.ReadAll(zr)
+	case bytes.HasPrefix(body, zstdMagic):
+		_, dec := zstdCodecs()
+		return dec.DecodeAll(body, nil)
+	default:
+		return body, nil
+	}
+}
+
+// parseSnapshots decodes and unmarshals the body of the snapshot object at
+// key: one cycle for a .json key, or a batch of cycles, one per line, for an
+// .ndjson key (see snapshotWriter).
+func parseSnapshots(key string, body []byte) ([]*SnapshotFile, error) {
+	data, err := decodeSnapshotBody(body)
+	if err != nil {
+		return nil, fmt.Errorf("decompress: %w", err)
+	}
+	if !strings.HasSuffix(key, ".ndjson") {
+		var snap SnapshotFile
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return nil, err
+		}
+		return []*SnapshotFile{&snap}, nil
+	}
+	var snaps []*SnapshotFile
+	for line := range bytes.Lines(data) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var snap SnapshotFile
+		if err := json.Unmarshal(line, &snap); err != nil {
+			return nil, fmt.Errorf("line %d: %w", len(snaps)+1, err)
+		}
+		snaps = append(snaps, &snap)
+	}
+	return snaps, nil
+}
+
+// readSnapshots fetches and parses the snapshot object at key.
+func readSnapshots(ctx context.Context, store objectStore, key string) ([]*SnapshotFile, error) {
+	rc, _, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, err
+	}
+	return parseSnapshots(key, body)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// snapshotBatchMinutes is SNAPSHOT_BATCH_MINUTES: the window of one .ndjson
+// batch, or 0 to write one object per cycle.
+var snapshotBatchMinutes int
+
+// snapshotCycles estimates how many cycles the snapshot object at key holds,
+// so readers can bound memory by cycles rather than objects: one for a
+// per-cycle file, a full window for a batch (an hour's worth if batching is
+// off now, as the window it was written with is unknown).
+func snapshotCycles(key string) int {
+	if !strings.HasSuffix(key, ".ndjson") {
+		return 1
+	}
+	minutes := snapshotBatchMinutes
+	if minutes == 0 {
+		minutes = 60
+	}
+	return max(1, minutes*60*1000/intervalMs)
+}
+
+// snapshotWriter writes each cycle's snapshot to the store, spooling writes
+// the store rejects. By default every cycle is its own object,
+// snapshots/YYYY/MM/DD/HHMMSS.json. With SNAPSHOT_BATCH_MINUTES=N, cycles are
+// buffered and written as one object per N-minute window,
+// snapshots/YYYY/MM/DD/HHMM.ndjson with one snapshot per line, which cuts
+// the objects a day's readers list and fetch by N*60/interval. N divides 60,
+// so a batch never straddles an hour (or a day).
+//
+// Buffered cycles are written when the first cycle of the next window
+// arrives, or by flush on shutdown; a crash loses at most one window.
+type snapshotWriter struct {
+	store objectStore
+	spool *snapshotSpool // nil: failed writes are returned
+	batch time.Duration  // 0: one object per cycle
+
+	window  time.Time    // start of the buffered window
+	pending bytes.Buffer // buffered NDJSON lines
+	cycles  int
+	// merge is set until a batch has been written: a restart inside a
+	// window finds the object written on shutdown and must extend it.
+	merge bool
+}
+
+func newSnapshotWriter(store objectStore, spool *snapshotSpool, batchMinutes int) *snapshotWriter {
+	return &snapshotWriter{
+		store: store,
+		spool: spool,
+		batch: time.Duration(batchMinutes) * time.Minute,
+		merge: true,
+	}
+}
+
+// write stores the snapshot of the cycle at now, or buffers it in batch mode
+// (writing the previous window's batch first if now starts a new one).
+func (w *snapshotWriter) write(ctx context.Context, snap *SnapshotFile, now time.Time) error {
+	line, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("marshal snapshot: %w", err)
+	}
+	if w.batch == 0 {
+		key := fmt.Sprintf("snapshots/%04d/%02d/%02d/%s.json",
+			now.Year(), now.Month(), now.Day(), now.Format("150405"))
+		return w.put(ctx, key, line, "application/json")
+	}
+
+	window := now.Truncate(w.batch)
+	if w.cycles > 0 && !window.Equal(w.window) {
+		// The batch belongs to earlier cycles, already counted, so losing
+		// it does not fail this one.
+		if err := w.flush(ctx); err != nil {
+			logger(ctx).Error("snapshot batch lost", "error", err)
+		}
+	}
+	if w.cycles == 0 {
+		w.window = window
+	}
+	w.pending.Write(line)
+	w.pending.WriteByte('\n')
+	w.cycles++
+	return nil
+}
+
+// flush writes the buffered batch, if any. If the batch stored by a previous
+// run cannot be read to be extended, the buffered cycles are dropped rather
+// than written over it.
+func (w *snapshotWriter) flush(ctx context.Context) error {
+	if w.cycles == 0 {
+		return nil
+	}
+	body := bytes.Clone(w.pending.Bytes())
+	cycles := w.cycles
+	w.pending.Reset()
+	w.cycles = 0
+
+	key := fmt.Sprintf("snapshots/%04d/%02d/%02d/%s.ndjson",
+		w.window.Year(), w.window.Month(), w.window.Day(), w.window.Format("1504"))
+	if w.merge {
+		earlier, err := w.existingBatch(ctx, key)
+		if err != nil {
+			return fmt.Errorf("read existing batch %s: %w", key, err)
+		}
+		body = append(earlier, body...)
+	}
+	if err := w.put(ctx, key, body, "application/x-ndjson"); err != nil {
+		return err
+	}
+	w.merge = false
+	logger(ctx).Debug("snapshot batch written", "key", key, "cycles", cycles)
+	return nil
+}
+
+// existingBatch returns the uncompressed lines already stored at key, or nil
+// if there is no such object.
+func (w *snapshotWriter) existingBatch(ctx context.Context, key string) ([]byte, error) {
+	rc, _, err := w.store.Get(ctx, key)
+	if errors.Is(err, errObjectNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, err
+	}
+	return decodeSnapshotBody(body)
+}
+
+// put compresses and writes one snapshot object, spooling it if the store
+// rejects it.
+func (w *snapshotWriter) put(ctx context.Context, key string, body []byte, contentType string) error {
+	body, encoding, err := encodeSnapshot(body)
+	if err != nil {
+		return fmt.Errorf("compress snapshot: %w", err)
+	}
+	opts := putOptions{ContentType: contentType, ContentEncoding: encoding}
+
+	start := time.Now()
+	err = w.store.Put(ctx, key, body, opts)
+	observeR2Put("snapshot", start, err)
+	if err == nil {
+		return nil
+	}
+	if w.spool == nil {
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	// Keep the cycle: the spool uploads it once the store recovers.
+	if spoolErr := w.spool.add(ctx, key, body, opts); spoolErr != nil {
+		return fmt.Errorf("write snapshot: %w (spool: %v)", err, spoolErr)
+	}
+	logger(ctx).Warn("snapshot write failed, spooled for retry", "key", key, "error", err)
+	return nil
+}
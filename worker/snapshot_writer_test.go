@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCycles writes one single-vehicle snapshot per cycle time to w.
+func writeTestCycles(t *testing.T, w *snapshotWriter, cycles ...time.Time) {
+	t.Helper()
+	for _, at := range cycles {
+		snap := &SnapshotFile{RecordedAt: at.Format(time.RFC3339), Positions: []SnapshotPosition{{VehicleID: "a", Route: "205"}}}
+		if err := w.write(context.Background(), snap, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// storedCycles returns the recorded times of the cycles in each snapshot
+// object under prefix, by key.
+func storedCycles(t *testing.T, store objectStore, prefix string) map[string][]string {
+	t.Helper()
+	got := make(map[string][]string)
+	for _, key := range listKeys(t, store, prefix) {
+		snaps, err := readSnapshots(context.Background(), store, key)
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		for _, s := range snaps {
+			got[key] = append(got[key], s.RecordedAt[11:19])
+		}
+	}
+	return got
+}
+
+func TestSnapshotWriterBatchesByWindow(t *testing.T) {
+	ctx := context.Background()
+	store := newTestLocalStore(t)
+	w := newSnapshotWriter(store, nil, 5)
+	at := time.Date(2025, 1, 30, 12, 0, 0, 0, time.UTC)
+
+	writeTestCycles(t, w, at, at.Add(30*time.Second), at.Add(4*time.Minute+30*time.Second))
+	if got := listKeys(t, store, "snapshots/"); len(got) != 0 {
+		t.Fatalf("window written before it ended: %q", got)
+	}
+	writeTestCycles(t, w, at.Add(5*time.Minute))
+	if err := w.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]string{
+		"snapshots/2025/01/30/1200.ndjson": {"12:00:00", "12:00:30", "12:04:30"},
+		"snapshots/2025/01/30/1205.ndjson": {"12:05:00"},
+	}
+	if got := storedCycles(t, store, "snapshots/"); !reflect.DeepEqual(got, want) {
+		t.Errorf("stored %v, want %v", got, want)
+	}
+}
+
+func TestSnapshotWriterMergesOnRestart(t *testing.T) {
+	ctx := context.Background()
+	store := newTestLocalStore(t)
+	at := time.Date(2025, 1, 30, 12, 0, 0, 0, time.UTC)
+
+	// Shut down mid-window, then restart in the same window.
+	w := newSnapshotWriter(store, nil, 5)
+	writeTestCycles(t, w, at, at.Add(30*time.Second))
+	if err := w.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	w = newSnapshotWriter(store, nil, 5)
+	writeTestCycles(t, w, at.Add(2*time.Minute), at.Add(5*time.Minute))
+	if err := w.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]string{
+		"snapshots/2025/01/30/1200.ndjson": {"12:00:00", "12:00:30", "12:02:00"},
+		"snapshots/2025/01/30/1205.ndjson": {"12:05:00"},
+	}
+	if got := storedCycles(t, store, "snapshots/"); !reflect.DeepEqual(got, want) {
+		t.Errorf("stored %v, want %v", got, want)
+	}
+}
+
+func TestSnapshotWriterKeepsUnreadableBatch(t *testing.T) {
+	ctx := context.Background()
+	store := newTestLocalStore(t)
+	const key = "snapshots/2025/01/30/1200.ndjson"
+	corrupt := append(append([]byte(nil), gzipMagic...), "not gzip"...)
+	if err := store.Put(ctx, key, corrupt, putOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := newSnapshotWriter(store, nil, 5)
+	writeTestCycles(t, w, time.Date(2025, 1, 30, 12, 1, 0, 0, time.UTC))
+	if err := w.flush(ctx); err == nil || !strings.Contains(err.Error(), key) {
+		t.Errorf("flush = %v, want the unreadable batch reported", err)
+	}
+	rc, _, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(rc)
+	rc.Close()
+	if !bytes.Equal(body, corrupt) {
+		t.Error("stored batch overwritten")
+	}
+
+	// Merging stays on until a batch is written.
+	if !w.merge {
+		t.Error("merge cleared by a failed flush")
+	}
+}
+
+func TestParseSnapshotsMixedLayouts(t *testing.T) {
+	ctx := context.Background()
+	store := newTestLocalStore(t)
+	day := time.Date(2025, 1, 30, 0, 0, 0, 0, time.UTC)
+
+	// Per-cycle files from before batching was switched on, then batches.
+	putTestSnapshot(t, store, day.Add(11*time.Hour+55*time.Minute), "a", "b")
+	putTestSnapshot(t, store, day.Add(11*time.Hour+59*time.Minute+30*time.Second), "a")
+	w := newSnapshotWriter(store, nil, 5)
+	writeTestCycles(t, w, day.Add(12*time.Hour), day.Add(12*time.Hour+30*time.Second))
+	if err := w.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]string{
+		"snapshots/2025/01/30/115500.json": {"11:55:00"},
+		"snapshots/2025/01/30/115930.json": {"11:59:30"},
+		"snapshots/2025/01/30/1200.ndjson": {"12:00:00", "12:00:30"},
+	}
+	if got := storedCycles(t, store, "snapshots/2025/01/30/"); !reflect.DeepEqual(got, want) {
+		t.Errorf("read %v, want %v", got, want)
+	}
+
+	// Blank lines, e.g. a trailing newline, are not cycles; a bad line fails
+	// the batch.
+	if snaps, err := parseSnapshots("x.ndjson", []byte("{\"recordedAt\":\"r\"}\n\n")); err != nil || len(snaps) != 1 {
+		t.Errorf("parseSnapshots = %d, %v", len(snaps), err)
+	}
+	if _, err := parseSnapshots("x.ndjson", []byte("{}\n{")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("parseSnapshots bad line = %v", err)
+	}
+}
+
+func TestSnapshotInputBatchesByCycles(t *testing.T) {
+	ctx := context.Background()
+	store := newTestLocalStore(t)
+	at := time.Date(2025, 1, 30, 0, 0, 0, 0, time.UTC)
+
+	// 600 cycles in 10-minute batches, with per-cycle files in between.
+	w := newSnapshotWriter(store, nil, 10)
+	for i := range 600 {
+		if i == 300 {
+			putTestSnapshot(t, store, at.Add(time.Duration(i)*30*time.Second+time.Second), "b")
+		}
+		writeTestCycles(t, w, at.Add(time.Duration(i)*30*time.Second))
+	}
+	if err := w.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	in := &snapshotInput{store: store, keys: listKeys(t, store, "snapshots/")}
+	var sizes []int
+	if err := in.Batches(ctx, func(batch []PositionPoint) error {
+		sizes = append(sizes, len(batch))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{snapshotBatchCycles, 601 - snapshotBatchCycles}; !reflect.DeepEqual(sizes, want) {
+		t.Errorf("batch sizes %v, want %v", sizes, want)
+	}
+}
+
+func TestRestoreBatches(t *testing.T) {
+	defer func(m int) { snapshotBatchMinutes = m }(snapshotBatchMinutes)
+	var perCycle []string
+	for i := range 40 {
+		perCycle = append(perCycle, fmt.Sprintf("snapshots/2025/01/30/%06d.json", i))
+	}
+
+	tests := []struct {
+		name         string
+		batchMinutes int
+		keys         []string
+		want         []int
+	}{
+		{"per-cycle files", 0, perCycle, []int{restoreBatch, 40 - restoreBatch}},
+		// 5-minute batches hold 10 cycles: three fit in restoreBatch.
+		{"batches", 5, []string{"0000.ndjson", "0005.ndjson", "0010.ndjson", "0015.ndjson"}, []int{3, 1}},
+		// Batching off now: a batch may hold an hour, more than restoreBatch.
+		{"batches written earlier", 0, []string{"0000.ndjson", "0005.ndjson"}, []int{1, 1}},
+		{"mixed", 5, append([]string{"0000.ndjson", "0005.ndjson"}, perCycle[:15]...), []int{14, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snapshotBatchMinutes = tt.batchMinutes
+			var sizes []int
+			for _, batch := range restoreBatches(tt.keys) {
+				sizes = append(sizes, len(batch))
+			}
+			if !reflect.DeepEqual(sizes, tt.want) {
+				t.Errorf("batch sizes %v, want %v", sizes, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFiwareURL = "https://broker.fiware.urbanplatform.portodigital.pt/v2/entities?q=vehicleType==bus&limit=1000"
+	userAgent        = "PortoMove-Collector/2.0"
+)
+
+// FeedSource is a realtime vehicle feed the collector can poll once per cycle.
+// Implementations own their transport and wire format and return parsed rows;
+// the collector loop takes care of snapshots and today.json.
+type FeedSource interface {
+	// Name identifies the source kind in logs (e.g. "fiware").
+	Name() string
+	// URL is the endpoint or path the source reads from, for logging.
+	URL() string
+	// Fetch returns the current vehicle positions.
+	Fetch(ctx context.Context) ([]*positionRow, error)
+}
+
+// newFeedSource builds the feed source selected by kind. An empty kind
+// defaults to FIWARE; an empty url falls back to the source's default.
+// dialect only applies to FIWARE ("v2" or "ld").
+func newFeedSource(kind, url, dialect string) (FeedSource, error) {
+	switch strings.ToLower(kind) {
+	case "", "fiware":
+		d, err := parseNGSIDialect(dialect)
+		if err != nil {
+			return nil, err
+		}
+		return newFiwareSource(url, d), nil
+	case "gtfs-rt", "gtfsrt":
+		if url == "" {
+			return nil, fmt.Errorf("gtfs-rt source requires a feed URL")
+		}
+		return newGTFSRTSource(url), nil
+	case "replay":
+		if url == "" {
+			return nil, fmt.Errorf("replay source requires a snapshot directory")
+		}
+		return newReplaySource(url)
+	default:
+		return nil, fmt.Errorf("unknown feed source %q (available: fiware, gtfs-rt, replay)", kind)
+	}
+}
+
+// replaySource replays SnapshotFile JSON files from a local directory, one
+// cycle per Fetch in lexical key order (a batched .ndjson file yields each of
+// its cycles in turn), looping when it reaches the end. The
+// directory layout mirrors the bucket, so a downloaded snapshots/YYYY/MM/DD/
+// prefix can be used as-is for offline development.
+type replaySource struct {
+	dir   string
+	mu    sync.Mutex
+	files []string
+	next  int
+	queue []*SnapshotFile // remaining cycles of the current batch file
+}
+
+func newReplaySource(dir string) (*replaySource, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && (strings.HasSuffix(path, ".json") || strings.HasSuffix(path, ".ndjson")) && filepath.Base(path) != "today.json" {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scan replay directory: %w", err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no snapshot files found in %s", dir)
+	}
+	sort.Strings(files)
+	return &replaySource{dir: dir, files: files}, nil
+}
+
+func (s *replaySource) Name() string { return "replay" }
+
+func (s *replaySource) URL() string { return s.dir }
+
+func (s *replaySource) Fetch(ctx context.Context) ([]*positionRow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) == 0 {
+		path := s.files[s.next]
+		s.next = (s.next + 1) % len(s.files)
+		body, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", path, err)
+		}
+		snaps, err := parseSnapshots(path, body)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		if len(snaps) == 0 {
+			return nil, fmt.Errorf("no snapshots in %s", path)
+		}
+		s.queue = snaps
+	}
+	snap := s.queue[0]
+	s.queue = s.queue[1:]
+
+	// Replayed positions are re-stamped with the current cycle's time, so
+	// they are not dropped as stale
+	rows := make([]*positionRow, 0, len(snap.Positions))
+	for i := range snap.Positions {
+		row := snapshotPositionToRow(&snap.Positions[i])
+		row.observedAt = nil
+		row.stale = false
+		row.duplicate = false
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// snapshotPositionToRow is the inverse of the collector's row → SnapshotPosition mapping.
+func snapshotPositionToRow(p *SnapshotPosition) *positionRow {
+	row := &positionRow{
+		vehicleID:   p.VehicleID,
+		directionID: p.DirectionID,
+		lat:         p.Lat,
+		lon:         p.Lon,
+		speed:       p.Speed,
+		heading:     p.Heading,
+		stale:       p.Stale,
+		duplicate:   p.Duplicate,
+	}
+	if p.ObservedAt != "" {
+		if t, err := time.Parse(time.RFC3339, p.ObservedAt); err == nil {
+			row.observedAt = &t
+		}
+	}
+	if p.VehicleNum != "" {
+		v := p.VehicleNum
+		row.vehicleNum = &v
+	}
+	if p.Route != "" {
+		r := p.Route
+		row.route = &r
+	}
+	if p.TripID != "" {
+		t := p.TripID
+		row.tripID = &t
+	}
+	return row
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// FIWARE entity types
+
+// ngsiDialect selects how broker responses are requested and parsed.
+type ngsiDialect string
+
+const (
+	ngsiV2 ngsiDialect = "v2"
+	ngsiLD ngsiDialect = "ld"
+)
+
+const defaultFiwareLDURL = "https://broker.fiware.urbanplatform.portodigital.pt/ngsi-ld/v1/entities?type=Vehicle&q=vehicleType==%22bus%22&limit=1000"
+
+func parseNGSIDialect(s string) (ngsiDialect, error) {
+	switch strings.ToLower(s) {
+	case "", "v2":
+		return ngsiV2, nil
+	case "ld", "ngsi-ld":
+		return ngsiLD, nil
+	default:
+		return "", fmt.Errorf("unknown NGSI dialect %q (available: v2, ld)", s)
+	}
+}
+
+type fiwareEntity struct {
+	Context                json.RawMessage `json:"@context"`
+	ID                     string          `json:"id"`
+	Type                   string          `json:"type"`
+	Location               json.RawMessage `json:"location"`
+	RouteShortName         json.RawMessage `json:"routeShortName"`
+	Route                  json.RawMessage `json:"route"`
+	LineID                 json.RawMessage `json:"lineId"`
+	Line                   json.RawMessage `json:"line"`
+	VehiclePlateIdentifier json.RawMessage `json:"vehiclePlateIdentifier"`
+	VehicleNumber          json.RawMessage `json:"vehicleNumber"`
+	LicensePlate           json.RawMessage `json:"license_plate"`
+	Name                   json.RawMessage `json:"name"`
+	Heading                json.RawMessage `json:"heading"`
+	Bearing                json.RawMessage `json:"bearing"`
+	Speed                  json.RawMessage `json:"speed"`
+	Annotations            json.RawMessage `json:"annotations"`
+	TimeInstant            json.RawMessage `json:"TimeInstant"`
+	DateModified           json.RawMessage `json:"dateModified"`
+	Timestamp              json.RawMessage `json:"timestamp"`
+	ModifiedAt             string          `json:"modifiedAt"` // NGSI-LD system attribute (options=sysAttrs)
+}
+
+// unwrapString extracts a string from either "value", an NGSI-LD Relationship
+// "object", or a raw string JSON value
+func unwrapString(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	var obj struct {
+		Value  string `json:"value"`
+		Object string `json:"object"`
+	}
+	if err := json.Unmarshal(raw, &obj); err == nil {
+		if obj.Value != "" {
+			return obj.Value
+		}
+		if obj.Object != "" {
+			return obj.Object
+		}
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	return ""
+}
+
+// unwrapFloat64 extracts a float64 from either {"value": N} or raw number
+func unwrapFloat64(raw json.RawMessage) (float64, bool) {
+	if len(raw) == 0 {
+		return 0, false
+	}
+	var obj struct {
+		Value *float64 `json:"value"`
+	}
+	if err := json.Unmarshal(raw, &obj); err == nil && obj.Value != nil {
+		return *obj.Value, true
+	}
+	var f float64
+	if err := json.Unmarshal(raw, &f); err == nil {
+		return f, true
+	}
+	return 0, false
+}
+
+// unwrapLocation extracts [lon, lat] coordinates from FIWARE location
+func unwrapLocation(raw json.RawMessage) (lon, lat float64, ok bool) {
+	if len(raw) == 0 {
+		return 0, 0, false
+	}
+	var nested struct {
+		Value struct {
+			Coordinates [2]float64 `json:"coordinates"`
+		} `json:"value"`
+	}
+	if err := json.Unmarshal(raw, &nested); err == nil && (nested.Value.Coordinates[0] != 0 || nested.Value.Coordinates[1] != 0) {
+		return nested.Value.Coordinates[0], nested.Value.Coordinates[1], true
+	}
+	var direct struct {
+		Coordinates [2]float64 `json:"coordinates"`
+	}
+	if err := json.Unmarshal(raw, &direct); err == nil && (direct.Coordinates[0] != 0 || direct.Coordinates[1] != 0) {
+		return direct.Coordinates[0], direct.Coordinates[1], true
+	}
+	return 0, 0, false
+}
+
+// unwrapAnnotations extracts string array from FIWARE annotations
+func unwrapAnnotations(raw json.RawMessage) []string {
+	if len(raw) == 0 {
+		return nil
+	}
+	var obj struct {
+		Value []string `json:"value"`
+	}
+	if err := json.Unmarshal(raw, &obj); err == nil && len(obj.Value) > 0 {
+		return obj.Value
+	}
+	var arr []string
+	if err := json.Unmarshal(raw, &arr); err == nil {
+		return arr
+	}
+	return nil
+}
+
+// unwrapObservedAt extracts the NGSI-LD "observedAt" timestamp of a Property or GeoProperty
+func unwrapObservedAt(raw json.RawMessage) (time.Time, bool) {
+	if len(raw) == 0 {
+		return time.Time{}, false
+	}
+	var obj struct {
+		ObservedAt string `json:"observedAt"`
+	}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return time.Time{}, false
+	}
+	return parseTimestamp(obj.ObservedAt)
+}
+
+// parseTimestamp parses an ISO 8601 broker timestamp
+func parseTimestamp(v string) (time.Time, bool) {
+	if v == "" {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t.UTC(), true
+}
+
+// unwrapTime extracts a timestamp from either {"value": "..."} or a raw string
+func unwrapTime(raw json.RawMessage) (time.Time, bool) {
+	return parseTimestamp(unwrapString(raw))
+}
+
+// unwrapMetadataTime extracts an NGSI v2 attribute metadata timestamp,
+// e.g. location.metadata.TimeInstant.value
+func unwrapMetadataTime(raw json.RawMessage, key string) (time.Time, bool) {
+	if len(raw) == 0 {
+		return time.Time{}, false
+	}
+	var obj struct {
+		Metadata map[string]json.RawMessage `json:"metadata"`
+	}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return time.Time{}, false
+	}
+	return unwrapTime(obj.Metadata[key])
+}
+
+// entityObservedAt returns when the broker last updated the entity's position.
+// NGSI-LD prefers the location's observedAt, then the modifiedAt system
+// attribute; NGSI v2 uses TimeInstant metadata on the location, then the
+// entity's TimeInstant, dateModified and timestamp attributes.
+func entityObservedAt(entity *fiwareEntity, dialect ngsiDialect) *time.Time {
+	if dialect == ngsiLD || len(entity.Context) > 0 {
+		if t, ok := unwrapObservedAt(entity.Location); ok {
+			return &t
+		} else if t, ok := unwrapObservedAt(entity.Speed); ok {
+			return &t
+		} else if t, ok := parseTimestamp(entity.ModifiedAt); ok {
+			return &t
+		}
+	}
+	if t, ok := unwrapMetadataTime(entity.Location, "TimeInstant"); ok {
+		return &t
+	} else if t, ok := unwrapTime(entity.TimeInstant); ok {
+		return &t
+	} else if t, ok := unwrapMetadataTime(entity.Location, "dateModified"); ok {
+		return &t
+	} else if t, ok := unwrapTime(entity.DateModified); ok {
+		return &t
+	} else if t, ok := unwrapTime(entity.Timestamp); ok {
+		return &t
+	}
+	return nil
+}
+
+var routePartRegex = regexp.MustCompile(`^[A-Za-z0-9]{1,4}$`)
+var stcpRegex = regexp.MustCompile(`(?i)STCP\s+(\d+)`)
+
+// parseEntity maps a broker entity onto a positionRow, including the
+// entity's own update time (see entityObservedAt). NGSI-LD entities are
+// detected by dialect or by an inline @context.
+func parseEntity(entity *fiwareEntity, dialect ngsiDialect) *positionRow {
+	lon, lat, ok := unwrapLocation(entity.Location)
+	if !ok {
+		return nil
+	}
+
+	var route string
+	if rsn := unwrapString(entity.RouteShortName); rsn != "" {
+		route = rsn
+	} else if rte := unwrapString(entity.Route); rte != "" {
+		route = rte
+	} else if lid := unwrapString(entity.LineID); lid != "" {
+		route = lid
+	} else if lin := unwrapString(entity.Line); lin != "" {
+		route = lin
+	} else {
+		vehicleID := unwrapString(entity.VehiclePlateIdentifier)
+		if vehicleID == "" {
+			vehicleID = unwrapString(entity.VehicleNumber)
+		}
+		if vehicleID == "" {
+			vehicleID = unwrapString(entity.LicensePlate)
+		}
+		if vehicleID == "" {
+			vehicleID = unwrapString(entity.Name)
+		}
+		if vehicleID != "" {
+			if m := stcpRegex.FindStringSubmatch(vehicleID); len(m) > 1 {
+				route = m[1]
+			}
+		}
+		if route == "" && entity.ID != "" {
+			parts := strings.Split(entity.ID, ":")
+			for i := 2; i < len(parts)-1; i++ {
+				p := parts[i]
+				if p != "" && p != "Vehicle" && p != "porto" && p != "stcp" && routePartRegex.MatchString(p) {
+					route = p
+					break
+				}
+			}
+			if route == "" && len(parts) >= 4 {
+				candidate := parts[len(parts)-2]
+				if candidate != "" && candidate != "Vehicle" && candidate != "stcp" {
+					route = candidate
+				}
+			}
+		}
+	}
+
+	var directionID *int16
+	var tripID *string
+	annotations := unwrapAnnotations(entity.Annotations)
+	for _, ann := range annotations {
+		if strings.HasPrefix(ann, "stcp:sentido:") {
+			var d int16
+			if _, err := fmt.Sscanf(ann, "stcp:sentido:%d", &d); err == nil {
+				directionID = &d
+			}
+		} else if strings.HasPrefix(ann, "stcp:nr_viagem:") {
+			t := strings.TrimPrefix(ann, "stcp:nr_viagem:")
+			tripID = &t
+		}
+	}
+
+	var vehicleNum *string
+	rawVehicleNum := unwrapString(entity.VehiclePlateIdentifier)
+	if rawVehicleNum == "" {
+		rawVehicleNum = unwrapString(entity.VehicleNumber)
+	}
+	if rawVehicleNum == "" {
+		rawVehicleNum = unwrapString(entity.LicensePlate)
+	}
+	if rawVehicleNum == "" {
+		rawVehicleNum = unwrapString(entity.Name)
+	}
+	if rawVehicleNum == "" {
+		parts := strings.Split(entity.ID, ":")
+		if len(parts) > 0 {
+			rawVehicleNum = parts[len(parts)-1]
+		}
+	}
+	if rawVehicleNum != "" {
+		parts := strings.Fields(rawVehicleNum)
+		last := parts[len(parts)-1]
+		isDigits := true
+		for _, c := range last {
+			if c < '0' || c > '9' {
+				isDigits = false
+				break
+			}
+		}
+		if isDigits && last != "" {
+			vehicleNum = &last
+		} else {
+			vehicleNum = &rawVehicleNum
+		}
+	}
+
+	var speed *float32
+	if s, ok := unwrapFloat64(entity.Speed); ok {
+		f := float32(s)
+		speed = &f
+	}
+	var heading *float32
+	if h, ok := unwrapFloat64(entity.Heading); ok {
+		f := float32(h)
+		heading = &f
+	} else if b, ok := unwrapFloat64(entity.Bearing); ok {
+		f := float32(b)
+		heading = &f
+	}
+
+	var routePtr *string
+	if route != "" {
+		routePtr = &route
+	}
+
+	return &positionRow{
+		vehicleID:   entity.ID,
+		vehicleNum:  vehicleNum,
+		route:       routePtr,
+		tripID:      tripID,
+		directionID: directionID,
+		lat:         lat,
+		lon:         lon,
+		speed:       speed,
+		heading:     heading,
+		observedAt:  entityObservedAt(entity, dialect),
+	}
+}
+
+// fiwareSource fetches bus entities from a FIWARE context broker, speaking
+// either NGSI v2 (Orion) or NGSI-LD. Fleets larger than one page are fetched
+// with offset pagination driven by the broker's total count.
+type fiwareSource struct {
+	url          string
+	dialect      ngsiDialect
+	pageSize     int
+	concurrency  int
+	cycleTimeout time.Duration
+	client       *http.Client
+}
+
+func newFiwareSource(url string, dialect ngsiDialect) *fiwareSource {
+	if url == "" {
+		url = defaultFiwareURL
+		if dialect == ngsiLD {
+			url = defaultFiwareLDURL
+		}
+	}
+	return &fiwareSource{
+		url:          url,
+		dialect:      dialect,
+		pageSize:     envInt("FIWARE_PAGE_SIZE", 1000),
+		concurrency:  envInt("FIWARE_PAGE_CONCURRENCY", 4),
+		cycleTimeout: envDuration("FIWARE_CYCLE_TIMEOUT", 25*time.Second),
+		client:       &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+func (s *fiwareSource) Name() string {
+	if s.dialect == ngsiLD {
+		return "fiware-ld"
+	}
+	return "fiware"
+}
+
+func (s *fiwareSource) URL() string { return s.url }
+
+func (s *fiwareSource) Fetch(ctx context.Context) ([]*positionRow, error) {
+	// The whole fleet must arrive within one cycle, however many pages it takes
+	ctx, cancel := context.WithTimeout(ctx, s.cycleTimeout)
+	defer cancel()
+
+	entities, total, err := s.fetchPage(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	pages := 1
+	if total > len(entities) && len(entities) > 0 {
+		// Step by what the broker actually returned: it may cap limit below
+		// FIWARE_PAGE_SIZE, and stepping by the requested size would skip
+		// entities.
+		step := len(entities)
+		var offsets []int
+		for off := step; off < total; off += step {
+			offsets = append(offsets, off)
+		}
+
+		results := make([][]fiwareEntity, len(offsets))
+		g, gctx := errgroup.WithContext(ctx)
+		g.SetLimit(s.concurrency)
+		for i, off := range offsets {
+			g.Go(func() error {
+				page, _, err := s.fetchPage(gctx, off)
+				if err != nil {
+					return fmt.Errorf("page at offset %d: %w", off, err)
+				}
+				results[i] = page
+				return nil
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return nil, err
+		}
+		for _, page := range results {
+			entities = append(entities, page...)
+		}
+		pages += len(offsets)
+	}
+
+	if len(entities) == 0 {
+		return nil, fmt.Errorf("FIWARE returned empty response")
+	}
+
+	if pages > 1 || len(entities) < total {
+		logger(ctx).Info("FIWARE entities fetched", "entities", len(entities), "total", total, "pages", pages)
+	}
+
+	// Entities can shift between pages while the broker updates; keep the first copy
+	seen := make(map[string]struct{}, len(entities))
+	rows := make([]*positionRow, 0, len(entities))
+	for i := range entities {
+		if entities[i].ID == "" {
+			continue
+		}
+		if _, dup := seen[entities[i].ID]; dup {
+			continue
+		}
+		seen[entities[i].ID] = struct{}{}
+		if row := parseEntity(&entities[i], s.dialect); row != nil {
+			rows = append(rows, row)
+			feedEntities.WithLabelValues("fiware", "parsed").Inc()
+		} else {
+			feedEntities.WithLabelValues("fiware", "dropped").Inc()
+		}
+	}
+	return rows, nil
+}
+
+// fetchPage requests one page of entities starting at offset and returns it
+// together with the broker-reported total (or the page length if the broker
+// did not report one).
+func (s *fiwareSource) fetchPage(ctx context.Context, offset int) ([]fiwareEntity, int, error) {
+	pageURL, err := s.pageURL(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", pageURL, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("User-Agent", userAgent)
+	if s.dialect == ngsiLD {
+		// ld+json makes the broker inline @context in every entity
+		req.Header.Set("Accept", "application/ld+json")
+	} else {
+		req.Header.Set("Accept", "application/json")
+	}
+	req.Header.Set("Cache-Control", "no-cache")
+
+	start := time.Now()
+	resp, err := s.client.Do(req)
+	observeFetch("fiware", start, resp)
+	if err != nil {
+		return nil, 0, fmt.Errorf("FIWARE fetch: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("FIWARE HTTP %d %s", resp.StatusCode, resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("read response: %w", err)
+	}
+
+	var entities []fiwareEntity
+	if err := json.Unmarshal(body, &entities); err != nil {
+		return nil, 0, fmt.Errorf("parse FIWARE JSON: %w", err)
+	}
+
+	total := len(entities)
+	countHeader := resp.Header.Get("Fiware-Total-Count")
+	if s.dialect == ngsiLD {
+		countHeader = resp.Header.Get("NGSILD-Results-Count")
+	}
+	if countHeader != "" {
+		if n, err := strconv.Atoi(countHeader); err == nil {
+			total = n
+		}
+	}
+	return entities, total, nil
+}
+
+// pageURL sets limit/offset, asks the broker for the total entity count
+// (options=count in NGSI v2, count=true in NGSI-LD) and for modification
+// timestamps (dateModified in v2, sysAttrs in LD) unless the URL already
+// selects attributes.
+func (s *fiwareSource) pageURL(offset int) (string, error) {
+	u, err := url.Parse(s.url)
+	if err != nil {
+		return "", fmt.Errorf("parse FIWARE URL: %w", err)
+	}
+	q := u.Query()
+	q.Set("limit", strconv.Itoa(s.pageSize))
+	q.Set("offset", strconv.Itoa(offset))
+	if s.dialect == ngsiLD {
+		q.Set("count", "true")
+		q.Set("options", addOption(q.Get("options"), "sysAttrs"))
+	} else {
+		q.Set("options", addOption(q.Get("options"), "count"))
+		if q.Get("attrs") == "" {
+			q.Set("attrs", "dateModified,*")
+		}
+		if q.Get("metadata") == "" {
+			q.Set("metadata", "dateModified,*")
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// addOption appends opt to a comma-separated options list if not already present.
+func addOption(opts, opt string) string {
+	if opts == "" {
+		return opt
+	}
+	for _, o := range strings.Split(opts, ",") {
+		if o == opt {
+			return opts
+		}
+	}
+	return opts + "," + opt
+}
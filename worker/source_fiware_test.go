@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// flatRow is a positionRow with its optional fields dereferenced, so expected
+// rows can be written as literals. Absent values are "" or -1.
+type flatRow struct {
+	vehicleID, vehicleNum, route, tripID string
+	directionID                          int
+	lat, lon                             float64
+	speed, heading                       float32
+	observedAt                           string
+}
+
+func flatten(r *positionRow) flatRow {
+	f := flatRow{vehicleID: r.vehicleID, directionID: -1, lat: r.lat, lon: r.lon, speed: -1, heading: -1}
+	if r.vehicleNum != nil {
+		f.vehicleNum = *r.vehicleNum
+	}
+	if r.route != nil {
+		f.route = *r.route
+	}
+	if r.tripID != nil {
+		f.tripID = *r.tripID
+	}
+	if r.directionID != nil {
+		f.directionID = int(*r.directionID)
+	}
+	if r.speed != nil {
+		f.speed = *r.speed
+	}
+	if r.heading != nil {
+		f.heading = *r.heading
+	}
+	if r.observedAt != nil {
+		f.observedAt = r.observedAt.Format(time.RFC3339Nano)
+	}
+	return f
+}
+
+func loadFiwareFixture(t *testing.T, name string) []fiwareEntity {
+	t.Helper()
+	body, err := os.ReadFile(filepath.Join("testdata", "fiware", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entities []fiwareEntity
+	if err := json.Unmarshal(body, &entities); err != nil {
+		t.Fatalf("parse %s: %v", name, err)
+	}
+	return entities
+}
+
+func TestParseEntity(t *testing.T) {
+	ldRows := []*flatRow{
+		{
+			// GeoProperty observedAt wins over the speed's and modifiedAt;
+			// the line comes from a Relationship.
+			vehicleID: "urn:ngsi-ld:Vehicle:porto:stcp:200:3301", vehicleNum: "3301", route: "200",
+			tripID: "200_0_2|7", directionID: 0, lat: 41.14, lon: -8.62, speed: 31.25, heading: 270,
+			observedAt: "2025-01-31T12:00:01.5Z",
+		},
+		{
+			// No observedAt on the location: the speed Property's.
+			vehicleID: "urn:ngsi-ld:Vehicle:porto:stcp:901:3302", vehicleNum: "3302", route: "901",
+			directionID: -1, lat: 41.13, lon: -8.64, speed: 12.5, heading: -1,
+			observedAt: "2025-01-31T11:59:30Z",
+		},
+		{
+			// Only the modifiedAt system attribute; route from the entity id.
+			vehicleID: "urn:ngsi-ld:Vehicle:porto:stcp:704:2201", vehicleNum: "2201", route: "704",
+			directionID: -1, lat: 41.12, lon: -8.66, speed: -1, heading: -1,
+			observedAt: "2025-01-31T11:57:00Z",
+		},
+		nil, // no location
+	}
+
+	tests := []struct {
+		fixture string
+		dialect ngsiDialect
+		want    []*flatRow
+	}{
+		{"v2_keyvalues.json", ngsiV2, []*flatRow{
+			{
+				vehicleID: "urn:ngsi-ld:Vehicle:porto:stcp:205:3245", vehicleNum: "3245", route: "205",
+				tripID: "205_1_3|12", directionID: 1, lat: 41.149, lon: -8.611, speed: 23.5, heading: 180,
+				observedAt: "2025-01-31T12:00:05.25Z",
+			},
+			{
+				// Route parsed from the name, time from dateModified.
+				vehicleID: "urn:ngsi-ld:Vehicle:porto:stcp:ZM:1999", vehicleNum: "1999", route: "ZM",
+				directionID: -1, lat: 41.2, lon: -8.7, speed: -1, heading: -1,
+				observedAt: "2025-01-31T11:55:00Z",
+			},
+			nil, // no location
+		}},
+		{"v2_normalized.json", ngsiV2, []*flatRow{
+			{
+				// location TimeInstant metadata wins over dateModified.
+				vehicleID: "urn:ngsi-ld:Vehicle:porto:stcp:502:1234", vehicleNum: "1234", route: "502",
+				directionID: 0, lat: 41.16, lon: -8.6, speed: 0, heading: 90,
+				observedAt: "2025-01-31T12:00:03Z",
+			},
+			{
+				vehicleID: "urn:ngsi-ld:Vehicle:porto:stcp:801:2002", vehicleNum: "2002", route: "801",
+				directionID: -1, lat: 41.18, lon: -8.58, speed: -1, heading: -1,
+				observedAt: "2025-01-31T11:58:30Z",
+			},
+		}},
+		{"ld.json", ngsiLD, ldRows},
+		// An inline @context marks NGSI-LD even when the source expects v2.
+		{"ld.json", ngsiV2, ldRows},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture+"/"+string(tt.dialect), func(t *testing.T) {
+			entities := loadFiwareFixture(t, tt.fixture)
+			if len(entities) != len(tt.want) {
+				t.Fatalf("fixture has %d entities, want %d", len(entities), len(tt.want))
+			}
+			for i := range entities {
+				row := parseEntity(&entities[i], tt.dialect)
+				switch {
+				case tt.want[i] == nil && row != nil:
+					t.Errorf("%s: got %+v, want dropped", entities[i].ID, flatten(row))
+				case tt.want[i] == nil:
+				case row == nil:
+					t.Errorf("%s: dropped, want %+v", entities[i].ID, *tt.want[i])
+				case flatten(row) != *tt.want[i]:
+					t.Errorf("%s:\n got %+v\nwant %+v", entities[i].ID, flatten(row), *tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestUnwrapHelpers(t *testing.T) {
+	for _, raw := range []string{`"205"`, `{"type":"Text","value":"205"}`, `{"type":"Relationship","object":"205"}`} {
+		if got := unwrapString(json.RawMessage(raw)); got != "205" {
+			t.Errorf("unwrapString(%s) = %q", raw, got)
+		}
+	}
+	for _, raw := range []string{`12.5`, `{"type":"Number","value":12.5}`, `{"type":"Property","value":12.5}`} {
+		if got, ok := unwrapFloat64(json.RawMessage(raw)); !ok || got != 12.5 {
+			t.Errorf("unwrapFloat64(%s) = %v, %v", raw, got, ok)
+		}
+	}
+	if _, ok := unwrapFloat64(json.RawMessage(`{"type":"Number"}`)); ok {
+		t.Error("unwrapFloat64 of an attribute without a value reported ok")
+	}
+	for _, raw := range []string{
+		`{"type":"Point","coordinates":[-8.6,41.1]}`,
+		`{"type":"geo:json","value":{"type":"Point","coordinates":[-8.6,41.1]}}`,
+		`{"type":"GeoProperty","value":{"type":"Point","coordinates":[-8.6,41.1]}}`,
+	} {
+		if lon, lat, ok := unwrapLocation(json.RawMessage(raw)); !ok || lon != -8.6 || lat != 41.1 {
+			t.Errorf("unwrapLocation(%s) = %v, %v, %v", raw, lon, lat, ok)
+		}
+	}
+	if _, _, ok := unwrapLocation(json.RawMessage(`{"type":"Point","coordinates":[0,0]}`)); ok {
+		t.Error("unwrapLocation accepted null island")
+	}
+	if _, ok := unwrapObservedAt(json.RawMessage(`{"type":"Property","value":1,"observedAt":"not a time"}`)); ok {
+		t.Error("unwrapObservedAt accepted an invalid timestamp")
+	}
+}
+
+func TestFiwareSourceFetchCappedPages(t *testing.T) {
+	const total, brokerMax = 10, 3
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		limit = min(limit, brokerMax)
+		var page []map[string]any
+		for i := offset; i < min(offset+limit, total); i++ {
+			page = append(page, map[string]any{
+				"id":       fmt.Sprintf("urn:ngsi-ld:Vehicle:porto:stcp:205:%d", 3000+i),
+				"type":     "Vehicle",
+				"location": map[string]any{"type": "Point", "coordinates": []float64{-8.6, 41.1 + float64(i)/1000}},
+			})
+		}
+		w.Header().Set("Fiware-Total-Count", strconv.Itoa(total))
+		json.NewEncoder(w).Encode(page)
+	}))
+	defer srv.Close()
+
+	src := newFiwareSource(srv.URL, ngsiV2)
+	src.pageSize = 1000
+	rows, err := src.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != total {
+		t.Errorf("got %d rows, want %d with the broker capping pages at %d", len(rows), total, brokerMax)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"google.golang.org/protobuf/proto"
+)
+
+// gtfsrtSource fetches a GTFS-Realtime VehiclePositions feed (protobuf FeedMessage).
+type gtfsrtSource struct {
+	url    string
+	client *http.Client
+}
+
+func newGTFSRTSource(url string) *gtfsrtSource {
+	return &gtfsrtSource{
+		url:    url,
+		client: &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+func (s *gtfsrtSource) Name() string { return "gtfs-rt" }
+
+func (s *gtfsrtSource) URL() string { return s.url }
+
+func (s *gtfsrtSource) Fetch(ctx context.Context) ([]*positionRow, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", s.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Accept", "application/x-protobuf, application/octet-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+
+	start := time.Now()
+	resp, err := s.client.Do(req)
+	observeFetch("gtfs-rt", start, resp)
+	if err != nil {
+		return nil, fmt.Errorf("GTFS-RT fetch: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GTFS-RT HTTP %d %s", resp.StatusCode, resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response: %w", err)
+	}
+
+	var feed gtfs.FeedMessage
+	if err := proto.Unmarshal(body, &feed); err != nil {
+		return nil, fmt.Errorf("parse GTFS-RT FeedMessage: %w", err)
+	}
+
+	if len(feed.GetEntity()) == 0 {
+		return nil, fmt.Errorf("GTFS-RT feed has no entities")
+	}
+
+	rows := make([]*positionRow, 0, len(feed.GetEntity()))
+	for _, entity := range feed.GetEntity() {
+		if entity.GetIsDeleted() {
+			continue
+		}
+		if row := parseVehiclePosition(entity.GetId(), entity.GetVehicle()); row != nil {
+			rows = append(rows, row)
+			feedEntities.WithLabelValues("gtfs-rt", "parsed").Inc()
+		} else {
+			feedEntities.WithLabelValues("gtfs-rt", "dropped").Inc()
+		}
+	}
+	return rows, nil
+}
+
+// parseVehiclePosition maps a GTFS-RT VehiclePosition onto a positionRow.
+// GTFS-RT speed is in m/s and is converted to km/h to match FIWARE.
+func parseVehiclePosition(entityID string, vp *gtfs.VehiclePosition) *positionRow {
+	if vp == nil || vp.GetPosition() == nil {
+		return nil
+	}
+	pos := vp.GetPosition()
+	if pos.GetLatitude() == 0 && pos.GetLongitude() == 0 {
+		return nil
+	}
+
+	vehicleID := vp.GetVehicle().GetId()
+	if vehicleID == "" {
+		vehicleID = entityID
+	}
+	if vehicleID == "" {
+		return nil
+	}
+
+	row := &positionRow{
+		vehicleID: vehicleID,
+		lat:       float64(pos.GetLatitude()),
+		lon:       float64(pos.GetLongitude()),
+	}
+
+	if label := vp.GetVehicle().GetLabel(); label != "" {
+		row.vehicleNum = &label
+	} else if plate := vp.GetVehicle().GetLicensePlate(); plate != "" {
+		row.vehicleNum = &plate
+	}
+
+	if trip := vp.GetTrip(); trip != nil {
+		if routeID := trip.GetRouteId(); routeID != "" {
+			row.route = &routeID
+		}
+		if tripID := trip.GetTripId(); tripID != "" {
+			row.tripID = &tripID
+		}
+		if trip.DirectionId != nil {
+			d := int16(trip.GetDirectionId())
+			row.directionID = &d
+		}
+	}
+
+	if pos.Speed != nil {
+		kmh := pos.GetSpeed() * 3.6
+		row.speed = &kmh
+	}
+	if pos.Bearing != nil {
+		b := pos.GetBearing()
+		row.heading = &b
+	}
+	if ts := vp.GetTimestamp(); ts > 0 {
+		t := time.Unix(int64(ts), 0).UTC()
+		row.observedAt = &t
+	}
+
+	return row
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+)
+
+// serveGTFSRTFixture serves testdata/gtfsrt/<name>.textproto as a binary
+// FeedMessage.
+func serveGTFSRTFixture(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+	text, err := os.ReadFile(filepath.Join("testdata", "gtfsrt", name+".textproto"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var feed gtfs.FeedMessage
+	if err := prototext.Unmarshal(text, &feed); err != nil {
+		t.Fatalf("parse %s: %v", name, err)
+	}
+	body, err := proto.Marshal(&feed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestGTFSRTSourceFetch(t *testing.T) {
+	srv := serveGTFSRTFixture(t, "vehicle_positions")
+	rows, err := newGTFSRTSource(srv.URL).Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("got %d rows, want 2 (deleted, position-less and zero entities dropped)", len(rows))
+	}
+
+	full := flatten(rows[0])
+	if full.vehicleID != "3245" || full.vehicleNum != "3245" || full.route != "205" ||
+		full.tripID != "205_1_3|12" || full.directionID != 1 || full.heading != 180 {
+		t.Errorf("full entity: got %+v", full)
+	}
+	if math.Abs(full.lat-41.149) > 1e-5 || math.Abs(full.lon+8.611) > 1e-5 {
+		t.Errorf("full entity: position %v,%v", full.lat, full.lon)
+	}
+	// 12.5 m/s is 45 km/h.
+	if math.Abs(float64(full.speed)-45) > 1e-3 {
+		t.Errorf("full entity: speed %v km/h, want 45", full.speed)
+	}
+	if want := time.Unix(1738324805, 0).UTC(); rows[0].observedAt == nil || !rows[0].observedAt.Equal(want) {
+		t.Errorf("full entity: observedAt %v, want %v", rows[0].observedAt, want)
+	}
+
+	// Float32 coordinates are checked approximately below.
+	sparse := flatten(rows[1])
+	want := flatRow{vehicleID: "e4", vehicleNum: "AA-00-BB", directionID: -1, lat: sparse.lat, lon: sparse.lon, speed: -1, heading: -1}
+	if sparse != want {
+		t.Errorf("sparse entity:\n got %+v\nwant %+v", sparse, want)
+	}
+	if math.Abs(sparse.lat-41.16) > 1e-5 || math.Abs(sparse.lon+8.6) > 1e-5 {
+		t.Errorf("sparse entity: position %v,%v", sparse.lat, sparse.lon)
+	}
+}
+
+func TestGTFSRTSourceFetchErrors(t *testing.T) {
+	empty, _ := proto.Marshal(&gtfs.FeedMessage{Header: &gtfs.FeedHeader{GtfsRealtimeVersion: proto.String("2.0")}})
+	tests := []struct {
+		name   string
+		status int
+		body   []byte
+	}{
+		{"http error", http.StatusServiceUnavailable, nil},
+		{"not protobuf", http.StatusOK, []byte("<html>")},
+		{"no entities", http.StatusOK, empty},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write(tt.body)
+			}))
+			defer srv.Close()
+			if _, err := newGTFSRTSource(srv.URL).Fetch(context.Background()); err == nil {
+				t.Error("Fetch succeeded, want error")
+			}
+		})
+	}
+}
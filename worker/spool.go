@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultSpoolMaxMB bounds the spool unless SPOOL_MAX_MB overrides it:
+	// roughly a day of snapshots.
+	defaultSpoolMaxMB = 512
+	// spoolRetryMin and spoolRetryMax bound the backoff between upload
+	// attempts while the store keeps failing.
+	spoolRetryMin = 5 * time.Second
+	spoolRetryMax = 5 * time.Minute
+)
+
+// snapshotSpool is an on-disk write-ahead spool for snapshot files the store
+// rejected. Each is kept under its object key in SPOOL_DIR and uploaded by a
+// background loop, oldest first, once the store accepts writes again. When
+// the spool is full the oldest files are dropped to make room.
+type snapshotSpool struct {
+	local    *localStore
+	store    objectStore
+	maxBytes int64
+	wake     chan struct{}
+
+	mu    sync.Mutex
+	sizes map[string]int64 // spooled key -> bytes
+	total int64
+}
+
+// newSnapshotSpool opens the spool in SPOOL_DIR, picking up files left by a
+// previous run. The default, a directory under the system temp dir, does not
+// survive a redeploy, so deployments point SPOOL_DIR at a volume.
+func newSnapshotSpool(ctx context.Context, store objectStore) (*snapshotSpool, error) {
+	dir := os.Getenv("SPOOL_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "portomove-spool")
+		logger(ctx).Warn("SPOOL_DIR not set, spooling to the temp dir, which a redeploy loses", "dir", dir)
+	}
+	local, err := newLocalStore(dir)
+	if err != nil {
+		return nil, fmt.Errorf("open spool: %w", err)
+	}
+	s := &snapshotSpool{
+		local:    local,
+		store:    store,
+		maxBytes: int64(envInt("SPOOL_MAX_MB", defaultSpoolMaxMB)) << 20,
+		wake:     make(chan struct{}, 1),
+		sizes:    make(map[string]int64),
+	}
+	keys, err := local.List(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("open spool: %w", err)
+	}
+	for _, key := range keys {
+		info, err := local.Head(ctx, key)
+		if err != nil {
+			continue
+		}
+		s.sizes[key] = info.Size
+		s.total += info.Size
+	}
+	s.updateMetrics()
+	return s, nil
+}
+
+func (s *snapshotSpool) String() string { return s.local.dir }
+
+// add spools body under key, dropping the oldest spooled files if it would
+// not otherwise fit.
+func (s *snapshotSpool) add(ctx context.Context, key string, body []byte, opts putOptions) error {
+	size := int64(len(body))
+	if size > s.maxBytes {
+		return fmt.Errorf("snapshot of %d bytes exceeds the spool size", size)
+	}
+
+	s.mu.Lock()
+	var drop []string
+	if s.total+size > s.maxBytes {
+		for _, k := range s.keysLocked() {
+			if s.total+size <= s.maxBytes {
+				break
+			}
+			drop = append(drop, k)
+			s.total -= s.sizes[k]
+			delete(s.sizes, k)
+		}
+	}
+	s.mu.Unlock()
+	if len(drop) > 0 {
+		s.local.Delete(ctx, drop)
+		spoolDropped.Add(float64(len(drop)))
+		logger(ctx).Warn("spool full, dropped oldest snapshots", "dropped", len(drop), "oldest", drop[0])
+	}
+
+	if err := s.local.Put(ctx, key, body, opts); err != nil {
+		return fmt.Errorf("spool %s: %w", key, err)
+	}
+	s.mu.Lock()
+	s.total += size - s.sizes[key]
+	s.sizes[key] = size
+	s.mu.Unlock()
+	s.updateMetrics()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// keysLocked returns the spooled keys oldest first (snapshot keys sort by
+// time). s.mu must be held.
+func (s *snapshotSpool) keysLocked() []string {
+	keys := make([]string, 0, len(s.sizes))
+	for k := range s.sizes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// run uploads spooled files until ctx is cancelled, backing off
+// exponentially while the store keeps failing.
+func (s *snapshotSpool) run(ctx context.Context) {
+	delay := spoolRetryMin
+	for {
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-s.wake:
+			timer.Stop()
+			// A fresh failure: give the store the current delay before retrying.
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+		case <-timer.C:
+		}
+
+		uploaded, err := s.flush(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			delay = min(delay*2, spoolRetryMax)
+			logger(ctx).Warn("spool upload failed, backing off",
+				"uploaded", uploaded, "remaining", s.len(), "retryIn", delay, "error", err)
+			continue
+		}
+		if uploaded > 0 {
+			logger(ctx).Info("spooled snapshots uploaded", "uploaded", uploaded)
+		}
+		delay = spoolRetryMin
+	}
+}
+
+// flush uploads spooled files oldest first, stopping at the first failure.
+func (s *snapshotSpool) flush(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	keys := s.keysLocked()
+	s.mu.Unlock()
+
+	uploaded := 0
+	for _, key := range keys {
+		rc, info, err := s.local.Get(ctx, key)
+		if err != nil {
+			// Usually dropped to make room since the key list was taken;
+			// anything else is unreadable and would be retried forever.
+			if !errors.Is(err, errObjectNotFound) {
+				logger(ctx).Warn("dropping unreadable spooled snapshot", "key", key, "error", err)
+				spoolDropped.Inc()
+			}
+			s.remove(ctx, key)
+			continue
+		}
+		body, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return uploaded, fmt.Errorf("read spooled %s: %w", key, err)
+		}
+
+		start := time.Now()
+		err = s.store.Put(ctx, key, body, putOptions{
+			ContentType:     info.ContentType,
+			ContentEncoding: info.ContentEncoding,
+			Metadata:        info.Metadata,
+		})
+		observeR2Put("spool", start, err)
+		if err != nil {
+			return uploaded, fmt.Errorf("upload %s: %w", key, err)
+		}
+		s.remove(ctx, key)
+		uploaded++
+		spoolUploaded.Inc()
+	}
+	return uploaded, nil
+}
+
+// remove deletes a file from the spool.
+func (s *snapshotSpool) remove(ctx context.Context, key string) {
+	s.local.Delete(ctx, []string{key})
+	s.mu.Lock()
+	s.total -= s.sizes[key]
+	delete(s.sizes, key)
+	s.mu.Unlock()
+	s.updateMetrics()
+}
+
+func (s *snapshotSpool) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sizes)
+}
+
+func (s *snapshotSpool) updateMetrics() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	spoolFiles.Set(float64(len(s.sizes)))
+	spoolBytes.Set(float64(s.total))
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+func TestSpoolFlushDropsUnreadable(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("SPOOL_DIR", t.TempDir())
+	store := newTestLocalStore(t)
+	spool, err := newSnapshotSpool(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	good, bad := "snapshots/2025/01/31/120000.json", "snapshots/2025/01/31/120030.json"
+	for _, key := range []string{good, bad} {
+		if err := spool.add(ctx, key, []byte("{}"), putOptions{ContentType: "application/json"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(spool.local.metaPath(bad), []byte("not json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	uploaded, err := spool.flush(ctx)
+	if err != nil || uploaded != 1 {
+		t.Fatalf("flush = %d, %v; want 1 uploaded", uploaded, err)
+	}
+	if n := spool.len(); n != 0 || spool.total != 0 {
+		t.Errorf("spool still tracks %d files (%d bytes) after flush", n, spool.total)
+	}
+	if _, err := store.Head(ctx, good); err != nil {
+		t.Errorf("spooled snapshot not uploaded: %v", err)
+	}
+}
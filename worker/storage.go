@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// errObjectNotFound is returned (wrapped) by Get and Head for a missing key.
+var errObjectNotFound = errors.New("object not found")
+
+// objectInfo is what a store knows about an object besides its contents.
+type objectInfo struct {
+	Size            int64
+	ContentType     string
+	ContentEncoding string
+	Metadata        map[string]string
+}
+
+// putOptions are the headers stored alongside an object by Put.
+type putOptions struct {
+	ContentType string
+	// ContentEncoding names the compression applied to the body (e.g.
+	// "gzip"); the body is stored as given either way.
+	ContentEncoding string
+	Metadata        map[string]string
+}
+
+// objectStore is where snapshots, archives and published feeds live: R2 in
+// production, or a local directory (STORAGE_BACKEND=local) for running the
+// pipeline offline. Keys are slash-separated, e.g. snapshots/2025/01/31/120000.json.
+type objectStore interface {
+	// Put writes body to key, replacing any existing object.
+	Put(ctx context.Context, key string, body []byte, opts putOptions) error
+	// Get opens key for reading. The caller closes the body.
+	Get(ctx context.Context, key string) (io.ReadCloser, objectInfo, error)
+	Head(ctx context.Context, key string) (objectInfo, error)
+	// List returns every key under prefix (a plain string prefix, not
+	// necessarily a directory), in lexical order.
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Delete removes keys and returns how many were deleted. Keys that fail
+	// individually are logged rather than returned as an error.
+	Delete(ctx context.Context, keys []string) (int, error)
+	// NewWriter streams a large object to key without holding it in memory.
+	NewWriter(ctx context.Context, key, contentType string) (objectWriter, error)
+	// String describes the store for logs, e.g. "r2://porto-move".
+	String() string
+}
+
+// objectWriter is a streaming upload. The object only appears at its key
+// once Complete succeeds; Abort discards it. A failed Complete discards
+// everything it wrote itself, so Abort after it does nothing.
+type objectWriter interface {
+	io.Writer
+	// Size is the number of bytes written so far.
+	Size() int64
+	Complete(metadata map[string]string) error
+	Abort()
+}
+
+// newObjectStore returns the store selected by STORAGE_BACKEND: "r2" (the
+// default, configured by the R2_* variables) or "local" (STORAGE_DIR, default
+// ./data). It returns nil without error when R2 credentials are not set.
+func newObjectStore() (objectStore, error) {
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "r2", "s3":
+		if s := newS3Store(); s != nil {
+			return s, nil
+		}
+		return nil, nil
+	case "local":
+		return newLocalStore(envOr("STORAGE_DIR", "data"))
+	default:
+		return nil, fmt.Errorf("invalid STORAGE_BACKEND=%q (use r2 or local)", backend)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// localMetaDir holds each object's content type, encoding and metadata as
+// .meta/<key>.json, since plain files have nowhere to keep them.
+const localMetaDir = ".meta"
+
+// localStore is an objectStore over a directory: key a/b.json is the file
+// <dir>/a/b.json. Writes go to a temp file that is renamed into place, so
+// readers never see a partial object.
+type localStore struct {
+	dir string
+}
+
+func newLocalStore(dir string) (*localStore, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(abs, 0o755); err != nil {
+		return nil, fmt.Errorf("create storage dir: %w", err)
+	}
+	return &localStore{dir: abs}, nil
+}
+
+func (s *localStore) String() string { return "file://" + s.dir }
+
+// path maps key to a file under dir, rejecting keys that would escape it.
+func (s *localStore) path(key string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(key)) || strings.HasPrefix(key, localMetaDir+"/") {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+type localMeta struct {
+	ContentType     string            `json:"contentType,omitempty"`
+	ContentEncoding string            `json:"contentEncoding,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+}
+
+func (s *localStore) metaPath(key string) string {
+	return filepath.Join(s.dir, localMetaDir, filepath.FromSlash(key)+".json")
+}
+
+func (s *localStore) Put(ctx context.Context, key string, body []byte, opts putOptions) error {
+	w, err := s.newWriter(key, opts.ContentType)
+	if err != nil {
+		return err
+	}
+	w.contentEncoding = opts.ContentEncoding
+	if _, err := w.Write(body); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Complete(opts.Metadata)
+}
+
+func (s *localStore) Get(ctx context.Context, key string) (io.ReadCloser, objectInfo, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, objectInfo{}, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, objectInfo{}, localNotFound(key, err)
+	}
+	info, err := s.info(key, f)
+	if err != nil {
+		f.Close()
+		return nil, objectInfo{}, err
+	}
+	return f, info, nil
+}
+
+func (s *localStore) Head(ctx context.Context, key string) (objectInfo, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return objectInfo{}, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return objectInfo{}, localNotFound(key, err)
+	}
+	defer f.Close()
+	return s.info(key, f)
+}
+
+func (s *localStore) info(key string, f *os.File) (objectInfo, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return objectInfo{}, err
+	}
+	info := objectInfo{Size: st.Size()}
+	if b, err := os.ReadFile(s.metaPath(key)); err == nil {
+		var m localMeta
+		if err := json.Unmarshal(b, &m); err != nil {
+			return objectInfo{}, fmt.Errorf("read metadata of %s: %w", key, err)
+		}
+		info.ContentType, info.ContentEncoding, info.Metadata = m.ContentType, m.ContentEncoding, m.Metadata
+	}
+	return info, nil
+}
+
+func localNotFound(key string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %s", errObjectNotFound, key)
+	}
+	return err
+}
+
+func (s *localStore) List(ctx context.Context, prefix string) ([]string, error) {
+	// Walk from the deepest directory the prefix names.
+	root := s.dir
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		root = filepath.Join(s.dir, filepath.FromSlash(prefix[:i]))
+	}
+	var keys []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if d.IsDir() {
+			if key == localMetaDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".tmp-") {
+			return nil
+		}
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list %s: %w", s.dir, err)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *localStore) Delete(ctx context.Context, keys []string) (int, error) {
+	deleted := 0
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return deleted, err
+		}
+		p, err := s.path(key)
+		if err == nil {
+			err = os.Remove(p)
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logger(ctx).Warn("failed to delete object", "key", key, "error", err)
+			continue
+		}
+		os.Remove(s.metaPath(key))
+		deleted++
+	}
+	return deleted, nil
+}
+
+func (s *localStore) NewWriter(ctx context.Context, key, contentType string) (objectWriter, error) {
+	return s.newWriter(key, contentType)
+}
+
+func (s *localStore) newWriter(key, contentType string) (*localWriter, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), ".tmp-"+path.Base(key)+"-*")
+	if err != nil {
+		return nil, err
+	}
+	return &localWriter{store: s, key: key, path: p, contentType: contentType, file: f}, nil
+}
+
+// localWriter writes to a temp file next to the object and renames it into
+// place on Complete.
+type localWriter struct {
+	store           *localStore
+	key             string
+	path            string
+	contentType     string
+	contentEncoding string
+	file            *os.File
+	size            int64
+}
+
+func (w *localWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *localWriter) Size() int64 { return w.size }
+
+func (w *localWriter) Complete(metadata map[string]string) error {
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return fmt.Errorf("write %s: %w", w.key, err)
+	}
+	// The sidecar is staged too, so a failed rename leaves the old object
+	// and its metadata as they were.
+	metaPath := w.store.metaPath(w.key)
+	metaTemp := ""
+	if w.contentType != "" || w.contentEncoding != "" || len(metadata) > 0 {
+		b, err := json.Marshal(localMeta{ContentType: w.contentType, ContentEncoding: w.contentEncoding, Metadata: metadata})
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(metaPath), 0o755)
+		}
+		if err == nil {
+			metaTemp = metaPath + ".tmp"
+			err = os.WriteFile(metaTemp, b, 0o644)
+		}
+		if err != nil {
+			os.Remove(w.file.Name())
+			if metaTemp != "" {
+				os.Remove(metaTemp)
+			}
+			return fmt.Errorf("write metadata of %s: %w", w.key, err)
+		}
+	}
+	if err := os.Rename(w.file.Name(), w.path); err != nil {
+		os.Remove(w.file.Name())
+		if metaTemp != "" {
+			os.Remove(metaTemp)
+		}
+		return fmt.Errorf("write %s: %w", w.key, err)
+	}
+	if metaTemp == "" {
+		os.Remove(metaPath)
+	} else if err := os.Rename(metaTemp, metaPath); err != nil {
+		return fmt.Errorf("write metadata of %s: %w", w.key, err)
+	}
+	return nil
+}
+
+func (w *localWriter) Abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func newTestLocalStore(t *testing.T) *localStore {
+	t.Helper()
+	s, err := newLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestLocalStorePutGetHead(t *testing.T) {
+	ctx := context.Background()
+	s := newTestLocalStore(t)
+
+	opts := putOptions{ContentType: "application/json", ContentEncoding: "gzip", Metadata: map[string]string{"rows": "3"}}
+	if err := s.Put(ctx, "snapshots/2025/01/31/120000.json", []byte("body"), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	rc, info, err := s.Get(ctx, "snapshots/2025/01/31/120000.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "body" {
+		t.Errorf("Get body = %q", body)
+	}
+	want := objectInfo{Size: 4, ContentType: "application/json", ContentEncoding: "gzip", Metadata: map[string]string{"rows": "3"}}
+	if !reflect.DeepEqual(info, want) {
+		t.Errorf("Get info = %+v, want %+v", info, want)
+	}
+	if head, err := s.Head(ctx, "snapshots/2025/01/31/120000.json"); err != nil || !reflect.DeepEqual(head, want) {
+		t.Errorf("Head = %+v, %v; want %+v", head, err, want)
+	}
+
+	// Overwriting without options drops the old metadata.
+	if err := s.Put(ctx, "snapshots/2025/01/31/120000.json", []byte("plain"), putOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if head, err := s.Head(ctx, "snapshots/2025/01/31/120000.json"); err != nil || !reflect.DeepEqual(head, objectInfo{Size: 5}) {
+		t.Errorf("Head after overwrite = %+v, %v", head, err)
+	}
+}
+
+func TestLocalStoreNotFound(t *testing.T) {
+	ctx := context.Background()
+	s := newTestLocalStore(t)
+
+	if _, _, err := s.Get(ctx, "missing.json"); !errors.Is(err, errObjectNotFound) {
+		t.Errorf("Get missing: %v, want errObjectNotFound", err)
+	}
+	if _, err := s.Head(ctx, "missing.json"); !errors.Is(err, errObjectNotFound) {
+		t.Errorf("Head missing: %v, want errObjectNotFound", err)
+	}
+	for _, key := range []string{"../outside.json", "/abs.json", ".meta/x.json"} {
+		if err := s.Put(ctx, key, nil, putOptions{}); err == nil {
+			t.Errorf("Put %q succeeded, want invalid key", key)
+		}
+	}
+}
+
+func TestLocalStoreList(t *testing.T) {
+	ctx := context.Background()
+	s := newTestLocalStore(t)
+
+	keys := []string{
+		"snapshots/2025/01/31/120030.json",
+		"snapshots/2025/01/31/120000.json",
+		"snapshots/2025/02/01/0000.ndjson",
+		"positions/2025/01/31.parquet",
+		"today.json",
+	}
+	for _, k := range keys {
+		if err := s.Put(ctx, k, []byte("x"), putOptions{ContentType: "application/json"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// An abandoned writer's temp file is not an object.
+	w, err := s.NewWriter(ctx, "snapshots/2025/01/31/partial.json", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Abort()
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"snapshots/2025/01/31/", []string{"snapshots/2025/01/31/120000.json", "snapshots/2025/01/31/120030.json"}},
+		{"snapshots/2025/0", []string{
+			"snapshots/2025/01/31/120000.json", "snapshots/2025/01/31/120030.json", "snapshots/2025/02/01/0000.ndjson",
+		}},
+		{"", []string{
+			"positions/2025/01/31.parquet", "snapshots/2025/01/31/120000.json", "snapshots/2025/01/31/120030.json",
+			"snapshots/2025/02/01/0000.ndjson", "today.json",
+		}},
+		{"archive/", nil},
+	}
+	for _, tt := range tests {
+		got, err := s.List(ctx, tt.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("List(%q) = %q, want %q", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestLocalStoreDelete(t *testing.T) {
+	ctx := context.Background()
+	s := newTestLocalStore(t)
+
+	for _, k := range []string{"a/1.json", "a/2.json"} {
+		if err := s.Put(ctx, k, []byte("x"), putOptions{Metadata: map[string]string{"k": "v"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := s.Delete(ctx, []string{"a/1.json", "a/missing.json"})
+	if err != nil || n != 2 {
+		t.Errorf("Delete = %d, %v; want 2 (missing keys count as deleted)", n, err)
+	}
+	if _, err := s.Head(ctx, "a/1.json"); !errors.Is(err, errObjectNotFound) {
+		t.Errorf("Head after Delete: %v", err)
+	}
+	if _, err := os.Stat(s.metaPath("a/1.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("metadata sidecar left behind: %v", err)
+	}
+	if got, _ := s.List(ctx, "a/"); !reflect.DeepEqual(got, []string{"a/2.json"}) {
+		t.Errorf("List after Delete = %q", got)
+	}
+}
+
+func TestLocalWriter(t *testing.T) {
+	ctx := context.Background()
+	s := newTestLocalStore(t)
+
+	w, err := s.NewWriter(ctx, "positions/2025/01/31.parquet", "application/vnd.apache.parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("PAR1"))
+	w.Write([]byte("PAR1"))
+	if w.Size() != 8 {
+		t.Errorf("Size = %d, want 8", w.Size())
+	}
+	if _, err := s.Head(ctx, "positions/2025/01/31.parquet"); !errors.Is(err, errObjectNotFound) {
+		t.Errorf("object visible before Complete: %v", err)
+	}
+	if err := w.Complete(map[string]string{"rows": "10"}); err != nil {
+		t.Fatal(err)
+	}
+	head, err := s.Head(ctx, "positions/2025/01/31.parquet")
+	if err != nil || head.Size != 8 || head.Metadata["rows"] != "10" || head.ContentType != "application/vnd.apache.parquet" {
+		t.Errorf("Head after Complete = %+v, %v", head, err)
+	}
+
+	w, err = s.NewWriter(ctx, "positions/2025/02/01.parquet", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("partial"))
+	w.Abort()
+	entries, _ := os.ReadDir(filepath.Join(s.dir, "positions", "2025", "02"))
+	if len(entries) != 0 {
+		t.Errorf("Abort left %d files behind", len(entries))
+	}
+}
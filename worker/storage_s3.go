@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// deleteBatchSize is the most keys S3 DeleteObjects accepts per call.
+const deleteBatchSize = 1000
+
+// s3Store is an objectStore backed by an R2 (or any S3-compatible) bucket.
+type s3Store struct {
+	client *s3.Client
+	bucket string
+}
+
+// newS3Store connects to R2 from R2_ENDPOINT, R2_ACCESS_KEY_ID,
+// R2_SECRET_ACCESS_KEY and R2_BUCKET, or returns nil if they are not set.
+func newS3Store() *s3Store {
+	endpoint := os.Getenv("R2_ENDPOINT")
+	accessKeyID := os.Getenv("R2_ACCESS_KEY_ID")
+	secretAccessKey := os.Getenv("R2_SECRET_ACCESS_KEY")
+
+	if endpoint == "" || accessKeyID == "" || secretAccessKey == "" {
+		return nil
+	}
+
+	bucket := os.Getenv("R2_BUCKET")
+	if bucket == "" {
+		bucket = "porto-move"
+	}
+
+	client := s3.New(s3.Options{
+		BaseEndpoint: &endpoint,
+		Region:       "auto",
+		Credentials:  credentials.NewStaticCredentialsProvider(accessKeyID, secretAccessKey, ""),
+	})
+
+	return &s3Store{client: client, bucket: bucket}
+}
+
+func (s *s3Store) String() string { return "r2://" + s.bucket }
+
+func (s *s3Store) Put(ctx context.Context, key string, body []byte, opts putOptions) error {
+	input := &s3.PutObjectInput{
+		Bucket:      &s.bucket,
+		Key:         &key,
+		Body:        bytes.NewReader(body),
+		ContentType: &opts.ContentType,
+		Metadata:    opts.Metadata,
+	}
+	if opts.ContentEncoding != "" {
+		input.ContentEncoding = &opts.ContentEncoding
+	}
+	_, err := s.client.PutObject(ctx, input)
+	return err
+}
+
+func (s *s3Store) Get(ctx context.Context, key string) (io.ReadCloser, objectInfo, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{Bucket: &s.bucket, Key: &key})
+	if err != nil {
+		return nil, objectInfo{}, s3NotFound(err)
+	}
+	return out.Body, objectInfo{
+		Size:            aws.ToInt64(out.ContentLength),
+		ContentType:     aws.ToString(out.ContentType),
+		ContentEncoding: aws.ToString(out.ContentEncoding),
+		Metadata:        out.Metadata,
+	}, nil
+}
+
+func (s *s3Store) Head(ctx context.Context, key string) (objectInfo, error) {
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: &s.bucket, Key: &key})
+	if err != nil {
+		return objectInfo{}, s3NotFound(err)
+	}
+	return objectInfo{
+		Size:            aws.ToInt64(out.ContentLength),
+		ContentType:     aws.ToString(out.ContentType),
+		ContentEncoding: aws.ToString(out.ContentEncoding),
+		Metadata:        out.Metadata,
+	}, nil
+}
+
+// s3NotFound wraps errObjectNotFound around the SDK's missing-key errors
+// (NoSuchKey from GetObject, a bare 404 NotFound from HeadObject).
+func s3NotFound(err error) error {
+	var noKey *types.NoSuchKey
+	var notFound *types.NotFound
+	if errors.As(err, &noKey) || errors.As(err, &notFound) {
+		return fmt.Errorf("%w: %v", errObjectNotFound, err)
+	}
+	return err
+}
+
+func (s *s3Store) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	var continuationToken *string
+
+	for {
+		out, err := s.client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:            &s.bucket,
+			Prefix:            &prefix,
+			ContinuationToken: continuationToken,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("list R2 objects: %w", err)
+		}
+		for _, obj := range out.Contents {
+			if obj.Key != nil {
+				keys = append(keys, *obj.Key)
+			}
+		}
+		if out.IsTruncated == nil || !*out.IsTruncated {
+			break
+		}
+		continuationToken = out.NextContinuationToken
+	}
+	return keys, nil
+}
+
+// Delete uses batched DeleteObjects calls.
+func (s *s3Store) Delete(ctx context.Context, keys []string) (int, error) {
+	deleted := 0
+	for start := 0; start < len(keys); start += deleteBatchSize {
+		end := start + deleteBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		objects := make([]types.ObjectIdentifier, 0, end-start)
+		for i := start; i < end; i++ {
+			objects = append(objects, types.ObjectIdentifier{Key: &keys[i]})
+		}
+		quiet := true
+		out, err := s.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: &s.bucket,
+			Delete: &types.Delete{Objects: objects, Quiet: &quiet},
+		})
+		if err != nil {
+			return deleted, err
+		}
+		for _, e := range out.Errors {
+			logger(ctx).Warn("failed to delete object", "key", aws.ToString(e.Key), "error", aws.ToString(e.Message))
+		}
+		deleted += len(objects) - len(out.Errors)
+	}
+	return deleted, nil
+}
+
+func (s *s3Store) NewWriter(ctx context.Context, key, contentType string) (objectWriter, error) {
+	return newMultipartUpload(ctx, s.client, s.bucket, key, contentType)
+}